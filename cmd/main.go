@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
 	"server/db"
 	"server/internal/handler"
 	"server/internal/repo"
@@ -16,20 +18,50 @@ func main() {
 		log.Fatalf("Something went wrong. Could not connect to the database. %s", err)
 	}
 
+	tokenConfig := service.TokenConfigFromEnv()
+	tokenService, err := service.NewTokenService(tokenConfig)
+	if err != nil {
+		log.Fatalf("Something went wrong. Could not load the token keys. %s", err)
+	}
+	sessionRepo := repo.NewSessionRepository(db.GetDB())
+	sessionService := service.NewSessionService(sessionRepo, tokenService, tokenConfig.RefreshTTL)
+
 	userRepo := repo.NewUserRepository(db.GetDB())
-	userService := service.NewUserService(userRepo)
+	userService := service.NewUserService(userRepo, sessionService)
+	if email := os.Getenv("ADMIN_EMAIL"); email != "" {
+		promoted, err := userService.BootstrapAdmin(context.Background(), email)
+		if err != nil {
+			log.Fatalf("Something went wrong. Could not set up the admin. %s", err)
+		}
+		if promoted {
+			log.Printf("%s is now an admin, ADMIN_EMAIL can be unset", email)
+		}
+	}
 	userHandler := handler.NewUserHandler(userService)
 
 	chatroom := repo.NewChatroomRepository(db.GetDB())
 	chatroomService := service.NewChatroomService(chatroom)
 	// chatroomHandler := handler.New(chatroomService)
 
-	hub := ws.NewHub()
-	wsHandler := handler.NewWSHandler(hub, chatroomService)
+	messageRepo := repo.NewMessageRepository(db.GetDB())
+	messageService := service.NewMessageService(messageRepo, chatroom, userRepo)
+
+	broker, err := ws.NewPostgresBroker(db.ConnString(), db.GetDB(), messageService)
+	if err != nil {
+		log.Fatalf("Something went wrong. Could not start the message broker. %s", err)
+	}
+	defer broker.Close()
+
+	presenceService := service.NewPresenceService(userRepo, chatroom)
+
+	hub := ws.NewHub(messageService, chatroomService, presenceService, broker, ws.ConfigFromEnv())
+	wsHandler := handler.NewWSHandler(hub, chatroomService, sessionService)
+	sessionHandler := handler.NewSessionHandler(sessionService, hub)
+	messageHandler := handler.NewMessageHandler(messageService, hub)
 
 	go hub.Run()
 
-	router.InitRouter(userHandler, wsHandler)
+	router.InitRouter(userHandler, wsHandler, messageHandler, sessionHandler)
 	router.Start("0.0.0.0:8080")
 
 	defer db.Close()
@@ -8,7 +8,8 @@ import (
 )
 
 type Database struct {
-	db *sql.DB
+	db      *sql.DB
+	connStr string
 }
 
 func NewDatabase() (*Database, error) {
@@ -27,7 +28,7 @@ func NewDatabase() (*Database, error) {
 		return nil, err
 	}
 
-	return &Database{db: db}, nil
+	return &Database{db: db, connStr: connStr}, nil
 }
 
 func (d *Database) Close() error {
@@ -37,3 +38,8 @@ func (d *Database) Close() error {
 func (d *Database) GetDB() *sql.DB {
 	return d.db
 }
+
+// ConnString is used by connections that cannot come from the pool, such as LISTEN.
+func (d *Database) ConnString() string {
+	return d.connStr
+}
@@ -0,0 +1,10 @@
+CREATE TABLE "chat_messages" (
+    "id" bigserial PRIMARY KEY,
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "sender_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "content" text NOT NULL,
+    "type" smallint NOT NULL DEFAULT 0,
+    "created_at" timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX chat_messages_room_id_id_idx ON chat_messages (room_id, id);
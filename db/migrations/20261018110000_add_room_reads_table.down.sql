@@ -0,0 +1 @@
+DROP TABLE IF EXISTS room_reads;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE "room_reads" (
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "last_read_seq" bigint NOT NULL DEFAULT 0,
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, room_id)
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS edited_at;
+ALTER TABLE chatrooms DROP COLUMN IF EXISTS moderators;
\ No newline at end of file
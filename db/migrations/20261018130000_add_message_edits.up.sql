@@ -0,0 +1,14 @@
+ALTER TABLE chatrooms ADD COLUMN moderators BIGINT[] DEFAULT array[]::BIGINT[];
+
+ALTER TABLE chat_messages ADD COLUMN edited_at timestamptz;
+ALTER TABLE chat_messages ADD COLUMN deleted_at timestamptz;
+
+CREATE TABLE "message_edits" (
+    "id" bigserial PRIMARY KEY,
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "editor_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "content" text NOT NULL,
+    "edited_at" timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id, id);
@@ -0,0 +1,7 @@
+CREATE TABLE "message_reactions" (
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "emoji" varchar(32) NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
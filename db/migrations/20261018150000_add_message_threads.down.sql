@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS chat_messages_parent_id_id_idx;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS last_reply_at;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS reply_count;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS parent_id;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS room_pins;
\ No newline at end of file
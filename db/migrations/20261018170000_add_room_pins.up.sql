@@ -0,0 +1,7 @@
+CREATE TABLE "room_pins" (
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "pinned_by" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "pinned_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (room_id, message_id)
+);
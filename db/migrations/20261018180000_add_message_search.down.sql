@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS chat_messages_search_idx;
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS search;
\ No newline at end of file
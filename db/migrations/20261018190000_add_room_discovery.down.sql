@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS chatrooms_public_activity_idx;
+DROP INDEX IF EXISTS chatrooms_public_members_idx;
+DROP INDEX IF EXISTS chatrooms_public_name_idx;
+DROP INDEX IF EXISTS chatrooms_clients_idx;
+DROP INDEX IF EXISTS chatrooms_name_trgm_idx;
+ALTER TABLE chatrooms DROP COLUMN IF EXISTS last_activity_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE sessions ADD COLUMN device_label varchar NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN ip varchar NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent varchar NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS ws_tickets;
\ No newline at end of file
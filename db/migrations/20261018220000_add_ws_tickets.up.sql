@@ -0,0 +1,7 @@
+CREATE TABLE "ws_tickets" (
+    "ticket_hash" bytea PRIMARY KEY,
+    "session_id" bigint NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    "expires_at" timestamptz NOT NULL
+);
+
+CREATE INDEX ws_tickets_expires_at_idx ON ws_tickets (expires_at);
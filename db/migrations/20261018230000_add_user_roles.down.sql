@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS role;
+DROP TYPE IF EXISTS userRole;
\ No newline at end of file
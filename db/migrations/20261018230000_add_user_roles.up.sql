@@ -0,0 +1,3 @@
+CREATE TYPE userRole AS ENUM ('user', 'moderator', 'admin');
+
+ALTER TABLE users ADD COLUMN role userRole NOT NULL DEFAULT 'user';
@@ -0,0 +1,5 @@
+ALTER TABLE chat_messages ADD COLUMN announcement boolean NOT NULL DEFAULT false;
+
+-- Only leave announcements have type 1. Join announcements were stored like other
+-- messages, so the earlier ones cannot be told apart and are left as they are.
+UPDATE chat_messages SET announcement = true WHERE type = 1;
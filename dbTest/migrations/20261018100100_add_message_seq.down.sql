@@ -0,0 +1 @@
+ALTER TABLE chat_messages DROP COLUMN IF EXISTS seq;ALTER TABLE chatrooms DROP COLUMN IF EXISTS last_seq;
\ No newline at end of file
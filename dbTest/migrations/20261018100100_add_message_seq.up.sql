@@ -0,0 +1,13 @@
+ALTER TABLE chatrooms ADD COLUMN last_seq bigint NOT NULL DEFAULT 0;
+ALTER TABLE chat_messages ADD COLUMN seq bigint;
+
+UPDATE chat_messages SET seq = numbered.seq
+FROM (SELECT id, row_number() OVER (PARTITION BY room_id ORDER BY id) AS seq FROM chat_messages) AS numbered
+WHERE chat_messages.id = numbered.id;
+
+UPDATE chatrooms SET last_seq = latest.seq
+FROM (SELECT room_id, max(seq) AS seq FROM chat_messages GROUP BY room_id) AS latest
+WHERE chatrooms.id = latest.room_id;
+
+ALTER TABLE chat_messages ALTER COLUMN seq SET NOT NULL;
+ALTER TABLE chat_messages ADD CONSTRAINT chat_messages_room_id_seq_key UNIQUE (room_id, seq);
@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN IF EXISTS last_seen;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE chat_messages ADD COLUMN parent_id bigint REFERENCES chat_messages (id) ON DELETE CASCADE;
+ALTER TABLE chat_messages ADD COLUMN reply_count int NOT NULL DEFAULT 0;
+ALTER TABLE chat_messages ADD COLUMN last_reply_at timestamptz;
+
+CREATE INDEX chat_messages_parent_id_id_idx ON chat_messages (parent_id, id) WHERE parent_id IS NOT NULL;
@@ -0,0 +1,7 @@
+CREATE TABLE "message_mentions" (
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX message_mentions_user_id_message_id_idx ON message_mentions (user_id, message_id);
@@ -0,0 +1,3 @@
+ALTER TABLE chat_messages ADD COLUMN search tsvector GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX chat_messages_search_idx ON chat_messages USING GIN (search);
@@ -0,0 +1,13 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE chatrooms ADD COLUMN last_activity_at timestamptz NOT NULL DEFAULT now();
+
+UPDATE chatrooms SET last_activity_at = activity.created_at
+FROM (SELECT room_id, max(created_at) AS created_at FROM chat_messages GROUP BY room_id) AS activity
+WHERE activity.room_id = chatrooms.id;
+
+CREATE INDEX chatrooms_name_trgm_idx ON chatrooms USING GIN (name gin_trgm_ops);
+CREATE INDEX chatrooms_clients_idx ON chatrooms USING GIN (clients);
+CREATE INDEX chatrooms_public_name_idx ON chatrooms (name, id) WHERE category = 'public';
+CREATE INDEX chatrooms_public_members_idx ON chatrooms ((cardinality(clients)), id) WHERE category = 'public';
+CREATE INDEX chatrooms_public_activity_idx ON chatrooms (last_activity_at, id) WHERE category = 'public';
@@ -0,0 +1,19 @@
+CREATE TABLE "sessions" (
+    "id" bigserial PRIMARY KEY,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "last_used_at" timestamptz NOT NULL DEFAULT now(),
+    "revoked_at" timestamptz
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE "refresh_tokens" (
+    "token_hash" bytea PRIMARY KEY,
+    "session_id" bigint NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "expires_at" timestamptz NOT NULL,
+    "used_at" timestamptz
+);
+
+CREATE INDEX refresh_tokens_session_id_idx ON refresh_tokens (session_id);
@@ -5,6 +5,8 @@ CREATE TABLE "users" (
     "password" varchar NOT NULL
 );
 
+ALTER TABLE users ADD COLUMN last_seen timestamptz;
+
 CREATE TYPE roomType AS ENUM ('public', 'private');
 
 CREATE TABLE "chatrooms" (
@@ -13,4 +15,116 @@ CREATE TABLE "chatrooms" (
     "clients" BIGINT[] DEFAULT array[]::BIGINT[]
 );
 
-ALTER TABLE chatrooms ADD COLUMN category roomType DEFAULT 'public';
\ No newline at end of file
+ALTER TABLE chatrooms ADD COLUMN category roomType DEFAULT 'public';
+ALTER TABLE chatrooms ADD COLUMN last_seq bigint NOT NULL DEFAULT 0;
+ALTER TABLE chatrooms ADD COLUMN moderators BIGINT[] DEFAULT array[]::BIGINT[];
+ALTER TABLE chatrooms ADD COLUMN last_activity_at timestamptz NOT NULL DEFAULT now();
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX chatrooms_name_trgm_idx ON chatrooms USING GIN (name gin_trgm_ops);
+CREATE INDEX chatrooms_clients_idx ON chatrooms USING GIN (clients);
+CREATE INDEX chatrooms_public_name_idx ON chatrooms (name, id) WHERE category = 'public';
+CREATE INDEX chatrooms_public_members_idx ON chatrooms ((cardinality(clients)), id) WHERE category = 'public';
+CREATE INDEX chatrooms_public_activity_idx ON chatrooms (last_activity_at, id) WHERE category = 'public';
+
+CREATE TABLE "chat_messages" (
+    "id" bigserial PRIMARY KEY,
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "sender_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "content" text NOT NULL,
+    "type" smallint NOT NULL DEFAULT 0,
+    "seq" bigint NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "edited_at" timestamptz,
+    "deleted_at" timestamptz,
+    "parent_id" bigint REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "reply_count" int NOT NULL DEFAULT 0,
+    "last_reply_at" timestamptz,
+    "search" tsvector GENERATED ALWAYS AS (to_tsvector('english', content)) STORED,
+    UNIQUE (room_id, seq)
+);
+
+CREATE INDEX chat_messages_room_id_id_idx ON chat_messages (room_id, id);
+CREATE INDEX chat_messages_parent_id_id_idx ON chat_messages (parent_id, id) WHERE parent_id IS NOT NULL;
+CREATE INDEX chat_messages_search_idx ON chat_messages USING GIN (search);
+
+CREATE TABLE "message_edits" (
+    "id" bigserial PRIMARY KEY,
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "editor_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "content" text NOT NULL,
+    "edited_at" timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id, id);
+
+CREATE TABLE "message_reactions" (
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "emoji" varchar(32) NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+CREATE TABLE "message_mentions" (
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX message_mentions_user_id_message_id_idx ON message_mentions (user_id, message_id);
+
+CREATE TABLE "room_pins" (
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "message_id" bigint NOT NULL REFERENCES chat_messages (id) ON DELETE CASCADE,
+    "pinned_by" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "pinned_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (room_id, message_id)
+);
+
+CREATE TABLE "room_reads" (
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "room_id" bigint NOT NULL REFERENCES chatrooms (id) ON DELETE CASCADE,
+    "last_read_seq" bigint NOT NULL DEFAULT 0,
+    "updated_at" timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, room_id)
+);
+
+CREATE TABLE "sessions" (
+    "id" bigserial PRIMARY KEY,
+    "user_id" bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "last_used_at" timestamptz NOT NULL DEFAULT now(),
+    "revoked_at" timestamptz
+);
+
+ALTER TABLE sessions ADD COLUMN device_label varchar NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN ip varchar NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent varchar NOT NULL DEFAULT '';
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE "refresh_tokens" (
+    "token_hash" bytea PRIMARY KEY,
+    "session_id" bigint NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "expires_at" timestamptz NOT NULL,
+    "used_at" timestamptz
+);
+
+CREATE INDEX refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+CREATE TABLE "ws_tickets" (
+    "ticket_hash" bytea PRIMARY KEY,
+    "session_id" bigint NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    "expires_at" timestamptz NOT NULL
+);
+
+CREATE INDEX ws_tickets_expires_at_idx ON ws_tickets (expires_at);
+
+CREATE TYPE userRole AS ENUM ('user', 'moderator', 'admin');
+
+ALTER TABLE users ADD COLUMN role userRole NOT NULL DEFAULT 'user';
+
+ALTER TABLE chat_messages ADD COLUMN announcement boolean NOT NULL DEFAULT false;
@@ -10,12 +10,25 @@ const (
 	UserIDNotFound
 	DuplicateEmail
 	DuplicateUsername
+	InvalidRole
 
 	DuplicateChatroom
 	ChatroomIDNotFound
 	ChatroomPrivate
 	ChatroomFull
-	
+	NotChatroomMember
+
+	MessageIDNotFound
+	NotMessageEditor
+	NotRoomModerator
+	TooManyPins
+
+	InvalidRefreshToken
+	RefreshTokenReused
+	SessionRevoked
+	SessionNotFound
+	InvalidTicket
+
 	Internal
 )
 
@@ -24,11 +37,24 @@ var (
 	ErrUserIDNotFound    = BackEndError{Kind: UserIDNotFound}
 	ErrDuplicateEmail    = BackEndError{Kind: DuplicateEmail}
 	ErrDuplicateUsername = BackEndError{Kind: DuplicateUsername}
+	ErrInvalidRole       = BackEndError{Kind: InvalidRole}
 
 	ErrDuplicateChatroom = BackEndError{Kind: DuplicateChatroom}
 	ErrChatroomIDNotFound  = BackEndError{Kind: ChatroomIDNotFound}
 	ErrChatroomPrivate = BackEndError{Kind: ChatroomPrivate}
 	ErrChatroomFull = BackEndError{Kind: ChatroomFull}
+	ErrNotChatroomMember = BackEndError{Kind: NotChatroomMember}
+
+	ErrMessageIDNotFound = BackEndError{Kind: MessageIDNotFound}
+	ErrNotMessageEditor  = BackEndError{Kind: NotMessageEditor}
+	ErrNotRoomModerator  = BackEndError{Kind: NotRoomModerator}
+	ErrTooManyPins       = BackEndError{Kind: TooManyPins}
+
+	ErrInvalidRefreshToken = BackEndError{Kind: InvalidRefreshToken}
+	ErrRefreshTokenReused  = BackEndError{Kind: RefreshTokenReused}
+	ErrSessionRevoked      = BackEndError{Kind: SessionRevoked}
+	ErrSessionNotFound     = BackEndError{Kind: SessionNotFound}
+	ErrInvalidTicket       = BackEndError{Kind: InvalidTicket}
 
 	ErrInternal = BackEndError{Kind: Internal}
 )
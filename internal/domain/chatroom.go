@@ -1,26 +1,110 @@
 package domain
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
 const (
 	Public  string = "public"
 	Private        = "private"
 )
 
+// Orders of the room list
+const (
+	RoomSortName     = "name"     // Alphabetical
+	RoomSortMembers  = "members"  // Most members first
+	RoomSortActivity = "activity" // Most recent message first
+)
+
+const (
+	DefaultRoomLimit = 50
+	MaxRoomLimit     = 100
+	MaxRoomSearch    = 100 // Length of a room search, in bytes
+)
+
 type Chatroom struct {
-	ID       int64   `json:"id"`
-	Name     string  `json:"name"`
-	Clients  []int64 `json:"clients"`
-	Category string  `json:"category"`
+	ID             int64        `json:"id"`
+	Name           string       `json:"name"`
+	Clients        []int64      `json:"clients"`
+	Category       string       `json:"category"`
+	UnreadCount    int64        `json:"unreadCount"` // Messages from other users after the user's read marker
+	LastMessage    *ChatMessage `json:"lastMessage"`
+	Moderators     []int64      `json:"moderators"`
+	MemberCount    int          `json:"memberCount"`
+	LastActivityAt time.Time    `json:"lastActivityAt"` // Time of the latest message, or of the room's creation
+}
+
+// GetRoomsReq selects a page of the public rooms. Joined, when set, keeps only the
+// rooms the user is (or is not) a member of.
+type GetRoomsReq struct {
+	UserID int64
+	Search string // Part of the room name, case-insensitive
+	Sort   string
+	Joined *bool
+	After  *RoomCursor
+	Limit  int
+}
+
+type GetRoomsRes struct {
+	Rooms      []*Chatroom `json:"rooms"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// RoomCursor is the position of the last room of a page in the page's order.
+// Clients pass it back as an opaque string.
+type RoomCursor struct {
+	Sort         string    `json:"s"`
+	ID           int64     `json:"id"`
+	Name         string    `json:"n,omitempty"`
+	MemberCount  int       `json:"m,omitempty"`
+	LastActivity time.Time `json:"a"`
+}
+
+func NewRoomCursor(sort string, room *Chatroom) *RoomCursor {
+	cursor := &RoomCursor{Sort: sort, ID: room.ID}
+	switch sort {
+	case RoomSortMembers:
+		cursor.MemberCount = room.MemberCount
+	case RoomSortActivity:
+		cursor.LastActivity = room.LastActivityAt
+	default:
+		cursor.Name = room.Name
+	}
+	return cursor
+}
+
+func (c *RoomCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func ParseRoomCursor(s string) (*RoomCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor RoomCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
 }
 
 type GetRoomByIDRepo struct {
-	ID       int64        `json:"id"`
-	Name     string       `json:"name"`
-	Clients  []PublicUser `json:"clients"`
-	Category string       `json:"category"`
+	ID         int64        `json:"id"`
+	Name       string       `json:"name"`
+	Clients    []PublicUser `json:"clients"`
+	Category   string       `json:"category"`
+	Moderators []int64      `json:"moderators"`
+	Pins       []*Pin       `json:"pins"`
 }
 
+// CreateChatroomReq creates a public room moderated by its creator.
 type CreateChatroomReq struct {
-	Name string `json:"name"`
+	Name      string `json:"name"`
+	CreatorID int64  `json:"creator_id"`
 }
 
 type CreateChatroomRes struct {
@@ -59,10 +143,12 @@ type GetChatroomByIDReq struct {
 }
 
 type GetChatroomByIDRes struct {
-	ID       int64        `json:"id"`
-	Name     string       `json:"name"`
-	Clients  []PublicUser `json:"clients"`
-	Category string       `json:"category"`
+	ID         int64        `json:"id"`
+	Name       string       `json:"name"`
+	Clients    []PublicUser `json:"clients"`
+	Category   string       `json:"category"`
+	Moderators []int64      `json:"moderators"`
+	Pins       []*Pin       `json:"pins"` // Most recently pinned first
 }
 
 type UpdateChatroomNameReq struct {
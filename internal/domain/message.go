@@ -0,0 +1,234 @@
+package domain
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultMessageLimit = 50
+	MaxMessageLimit     = 100
+	MaxReplayMessages   = 1000
+	MaxEmojiLength      = 32 // In bytes, enough for emoji built from several code points
+	MaxMentions         = 20 // Per message, further @username tokens are ignored
+	MaxPins             = 50 // Per room
+	MaxSearchLength     = 200
+)
+
+type ChatMessage struct {
+	ID        int64            `json:"id"`
+	RoomID    int64            `json:"roomId"`
+	SenderID  int64            `json:"senderId"`
+	Username  string           `json:"username"`
+	Content   string           `json:"content"`
+	Type      int              `json:"type"`
+	Seq       int64            `json:"seq"`
+	CreatedAt time.Time        `json:"createdAt"`
+	EditedAt  *time.Time       `json:"editedAt,omitempty"`
+	DeletedAt *time.Time       `json:"deletedAt,omitempty"` // Set on tombstones, whose content is empty
+	Reactions []*ReactionCount `json:"reactions,omitempty"`
+
+	// Replies have the ID of the message they reply to; that message counts them.
+	// Threads are one level deep: a reply cannot be replied to.
+	ParentID    int64      `json:"parentId,omitempty"`
+	ReplyCount  int        `json:"replyCount,omitempty"`
+	LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+
+	Mentions []int64 `json:"mentions,omitempty"` // IDs of the users mentioned when the message was sent
+
+	Announcement bool `json:"-"` // Join and leave notices, never counted as unread
+}
+
+type GetMessagesReq struct {
+	RoomID int64 `json:"roomId"`
+	UserID int64 `json:"userId"`
+	Before int64 `json:"before"`
+	Limit  int   `json:"limit"`
+}
+
+type GetMessagesRes struct {
+	Messages   []*ChatMessage `json:"messages"`
+	NextBefore int64          `json:"nextBefore,omitempty"`
+}
+
+// GetThreadReq pages through the replies to the message with ID MessageID like GetMessagesReq.
+type GetThreadReq struct {
+	RoomID    int64 `json:"roomId"`
+	MessageID int64 `json:"messageId"`
+	UserID    int64 `json:"userId"`
+	Before    int64 `json:"before"`
+	Limit     int   `json:"limit"`
+}
+
+type GetThreadRes struct {
+	Parent     *ChatMessage   `json:"parent"`
+	Replies    []*ChatMessage `json:"replies"`
+	NextBefore int64          `json:"nextBefore,omitempty"`
+}
+
+type MarkReadReq struct {
+	RoomID int64 `json:"roomId"`
+	UserID int64 `json:"userId"`
+	Seq    int64 `json:"seq"`
+}
+
+// EditMessageReq replaces the content of a message. UserID must be the sender or a moderator of the room.
+type EditMessageReq struct {
+	ID      int64  `json:"id"`
+	UserID  int64  `json:"userId"`
+	Content string `json:"content"`
+}
+
+// DeleteMessageReq turns a message into a tombstone. UserID must be the sender or a moderator of the room.
+type DeleteMessageReq struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"userId"`
+}
+
+type GetMessageEditsReq struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"userId"`
+}
+
+// MessageEdit is an earlier version of a message, replaced by EditorID at EditedAt.
+type MessageEdit struct {
+	MessageID int64     `json:"messageId"`
+	EditorID  int64     `json:"editorId"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+}
+
+// GetMentionsReq pages through the messages mentioning UserID, newest first.
+type GetMentionsReq struct {
+	UserID int64 `json:"userId"`
+	Before int64 `json:"before"`
+	Limit  int   `json:"limit"`
+}
+
+type GetMentionsRes struct {
+	Mentions   []*ChatMessage `json:"mentions"`
+	NextBefore int64          `json:"nextBefore,omitempty"`
+}
+
+// SearchMessagesReq searches the rooms UserID is a member of for messages matching
+// Query, newest first. RoomID and FromID narrow the search to one room and one
+// sender, Before continues from the NextBefore of the previous page.
+type SearchMessagesReq struct {
+	UserID int64  `json:"userId"`
+	Query  string `json:"q"`
+	RoomID int64  `json:"roomId"`
+	FromID int64  `json:"from"`
+	Before int64  `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+// SearchResult is a message matching a search. Snippet is an HTML-escaped excerpt
+// of the content with the matching words wrapped in <mark> tags.
+type SearchResult struct {
+	Message *ChatMessage `json:"message"`
+	Snippet string       `json:"snippet"`
+}
+
+type SearchMessagesRes struct {
+	Results    []*SearchResult `json:"results"`
+	NextBefore int64           `json:"nextBefore,omitempty"`
+}
+
+// ParseMentions returns the distinct usernames written as @username in content, in
+// order, at most MaxMentions of them. A username runs until a character other than
+// a letter, digit, '_', '.' or '-'; a trailing '.' or '-' is taken as punctuation.
+// An @ right after a letter or digit, as in an email address, is not a mention.
+func ParseMentions(content string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	runes := []rune(content)
+	for i := 0; i < len(runes) && len(usernames) < MaxMentions; i++ {
+		if runes[i] != '@' || i > 0 && isUsernameRune(runes[i-1]) {
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && isUsernameRune(runes[j]) {
+			j++
+		}
+		username := strings.TrimRight(string(runes[i+1:j]), ".-")
+		if username != "" && !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+		i = j - 1
+	}
+	return usernames
+}
+
+func isUsernameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+// PinReq pins the message with ID MessageID in its room, or unpins it. UserID must moderate the room.
+type PinReq struct {
+	RoomID    int64 `json:"roomId"`
+	MessageID int64 `json:"messageId"`
+	UserID    int64 `json:"userId"`
+}
+
+type GetPinsReq struct {
+	RoomID int64 `json:"roomId"`
+	UserID int64 `json:"userId"`
+}
+
+// Pin is a message pinned to its room by PinnedBy. Message is not set on pins
+// that were just removed.
+type Pin struct {
+	RoomID    int64        `json:"roomId"`
+	MessageID int64        `json:"messageId"`
+	PinnedBy  int64        `json:"pinnedBy"`
+	PinnedAt  time.Time    `json:"pinnedAt"`
+	Message   *ChatMessage `json:"message,omitempty"`
+}
+
+// ReactReq adds UserID's Emoji reaction to the message with ID MessageID, or
+// removes it when Remove is set. Either way it is a no-op when already done.
+type ReactReq struct {
+	MessageID int64  `json:"messageId"`
+	UserID    int64  `json:"userId"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove"`
+}
+
+// Reaction is the outcome of a ReactReq. Changed is false when the reaction was
+// already there, or already gone; Count is the number of users left with the emoji.
+type Reaction struct {
+	MessageID int64  `json:"messageId"`
+	RoomID    int64  `json:"roomId"`
+	ParentID  int64  `json:"parentId,omitempty"` // Set when the message is a reply
+	UserID    int64  `json:"userId"`
+	Emoji     string `json:"emoji"`
+	Removed   bool   `json:"removed"`
+	Changed   bool   `json:"changed"`
+	Count     int    `json:"count"`
+}
+
+// ReactionCount sums up the reactions to a message with one emoji, in the order the users reacted.
+type ReactionCount struct {
+	Emoji   string  `json:"emoji"`
+	Count   int     `json:"count"`
+	UserIDs []int64 `json:"userIds"`
+}
+
+// ValidEmoji reports whether emoji may be used as a reaction: it must be short and
+// contain neither spaces nor control characters.
+func ValidEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > MaxEmojiLength {
+		return false
+	}
+	return strings.IndexFunc(emoji, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) < 0
+}
+
+// ReadReceipt records that a user has read a room up to and including LastReadSeq.
+type ReadReceipt struct {
+	RoomID      int64     `json:"roomId"`
+	UserID      int64     `json:"userId"`
+	LastReadSeq int64     `json:"lastReadSeq"`
+	ReadAt      time.Time `json:"readAt"`
+}
@@ -0,0 +1,32 @@
+package domain
+
+import "time"
+
+// Session is a login, kept alive by exchanging its refresh token for a new one.
+// Revoking it invalidates its refresh token and the access tokens issued for it.
+type Session struct {
+	ID          int64      `json:"id"`
+	UserID      int64      `json:"userId"`
+	Username    string     `json:"-"`
+	Role        string     `json:"-"` // Current role of the user
+	DeviceLabel string     `json:"deviceLabel"`
+	IP          string     `json:"ip"`        // Address the user logged in from
+	UserAgent   string     `json:"userAgent"` // At login
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastUsedAt  time.Time  `json:"lastUsedAt"` // Last refresh
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+	Current     bool       `json:"current"` // Session of the request that listed it
+}
+
+// WSTicket authenticates one WebSocket connection for the session it was issued
+// to. It can be used once, before ExpiresAt.
+type WSTicket struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RefreshTokenReq carries a refresh token; clients that keep it in the
+// refresh_token cookie may leave it empty.
+type RefreshTokenReq struct {
+	RefreshToken string `json:"refreshToken"`
+}
@@ -1,10 +1,58 @@
 package domain
 
+import "time"
+
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceDND     = "dnd"
+	PresenceOffline = "offline"
+)
+
+// Roles a user can have across the whole server. Moderators may moderate every
+// room, admins may also change roles, wipe data and see the server's stats.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permission is something only some roles may do.
+type Permission int
+
+const (
+	_ Permission = iota
+	PermModerateRooms
+	PermManageRoles
+	PermWipeData
+	PermViewStats
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleModerator: {PermModerateRooms},
+	RoleAdmin:     {PermModerateRooms, PermManageRoles, PermWipeData, PermViewStats},
+}
+
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
+// RoleCan reports whether users with the role have the permission.
+func RoleCan(role string, p Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
 	ID       int64  `json:"id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
 }
 
 type CreateUserReq struct {
@@ -20,14 +68,21 @@ type CreateUserRes struct {
 }
 
 type LoginUserReq struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DeviceLabel string `json:"deviceLabel"` // Name of the device in the session list
+	IP          string `json:"-"`
+	UserAgent   string `json:"-"`
 }
 
 type LoginUserRes struct {
-	AccessToken string `json:"accessToken"`
-	ID          int64  `json:"id"`
-	Username    string `json:"username"`
+	AccessToken      string    `json:"accessToken"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+	ID               int64     `json:"id"`
+	Username         string    `json:"username"`
+	Role             string    `json:"role"`
 }
 
 type UpdateUsernameReq struct {
@@ -36,6 +91,11 @@ type UpdateUsernameReq struct {
 	Email    string `json:"email"`
 }
 
+type UpdateRoleReq struct {
+	ID   int64  `json:"-"`
+	Role string `json:"role"`
+}
+
 type UpdatePasswordReq struct {
 	ID       int64  `json:"id"`
 	Password string `json:"password"`
@@ -45,4 +105,22 @@ type PublicUser struct {
 	ID       int64  `json:"id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	Role     string `json:"role,omitempty"`
+}
+
+// Presence is whether a user is connected anywhere. LastSeen is set when they are offline
+// and have been connected before.
+type Presence struct {
+	UserID   int64      `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// TokenClaims identify the user and session an access token was issued to.
+type TokenClaims struct {
+	UserID    int64
+	Username  string
+	SessionID int64
+	Role      string
+	ExpiresAt time.Time
 }
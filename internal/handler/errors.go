@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"server/internal/domain"
+)
+
+// errorStatus maps a service error to the HTTP status it should be reported with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrChatroomIDNotFound), errors.Is(err, domain.ErrUserIDNotFound), errors.Is(err, domain.ErrMessageIDNotFound), errors.Is(err, domain.ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrNotChatroomMember), errors.Is(err, domain.ErrNotMessageEditor), errors.Is(err, domain.ErrNotRoomModerator):
+		return http.StatusForbidden
+	case errors.Is(err, domain.ErrInvalidRole):
+		return http.StatusBadRequest
+	case errors.Is(err, domain.ErrTooManyPins):
+		return http.StatusConflict
+	case errors.Is(err, domain.ErrInvalidRefreshToken), errors.Is(err, domain.ErrRefreshTokenReused), errors.Is(err, domain.ErrSessionRevoked),
+		errors.Is(err, domain.ErrInvalidTicket):
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,401 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"server/internal/domain"
+	"server/internal/port"
+	"server/internal/ws"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MessageHandler struct {
+	port.MessageServicePort
+	hub *ws.Hub
+}
+
+func NewMessageHandler(s port.MessageServicePort, hub *ws.Hub) *MessageHandler {
+	return &MessageHandler{s, hub}
+}
+
+func (h *MessageHandler) GetMessages(c *gin.Context) {
+	roomID, err := strconv.ParseInt(c.Param("roomId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &domain.GetMessagesReq{
+		RoomID: roomID,
+		UserID: clientID,
+	}
+	if before := c.Query("before"); before != "" {
+		req.Before, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a message id"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		req.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+			return
+		}
+	}
+
+	res, err := h.MessageServicePort.GetMessages(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// MarkRead moves the user's read marker for the room and sends a read receipt to the room.
+func (h *MessageHandler) MarkRead(c *gin.Context) {
+	roomID, err := strconv.ParseInt(c.Param("roomId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req domain.MarkReadReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Seq <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seq is required"})
+		return
+	}
+
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.RoomID = roomID
+	req.UserID = clientID
+
+	receipt, err := h.MessageServicePort.MarkRead(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	h.hub.Read(receipt, c.MustGet("username").(string))
+
+	c.JSON(http.StatusOK, receipt)
+}
+
+// messageRequest reads the message ID from the path and the user ID from the token.
+func messageRequest(c *gin.Context) (messageID int64, clientID int64, ok bool) {
+	messageID, err := strconv.ParseInt(c.Param("messageId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, 0, false
+	}
+
+	userID := c.MustGet("userID").(string)
+	clientID, err = strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, 0, false
+	}
+	return messageID, clientID, true
+}
+
+// EditMessage replaces the content of a message and sends the edit to its room.
+func (h *MessageHandler) EditMessage(c *gin.Context) {
+	var req domain.EditMessageReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" || len(req.Content) > ws.MaxContentLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("content must be between 1 and %d bytes", ws.MaxContentLength)})
+		return
+	}
+
+	var ok bool
+	if req.ID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+
+	m, err := h.MessageServicePort.EditMessage(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	h.hub.UpdateMessage(m)
+
+	c.JSON(http.StatusOK, m)
+}
+
+// DeleteMessage turns a message into a tombstone and sends it to the message's room.
+func (h *MessageHandler) DeleteMessage(c *gin.Context) {
+	var req domain.DeleteMessageReq
+	var ok bool
+	if req.ID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+
+	m, err := h.MessageServicePort.DeleteMessage(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	h.hub.UpdateMessage(m)
+
+	c.JSON(http.StatusOK, m)
+}
+
+// GetMessageEdits returns the previous versions of a message, oldest first.
+func (h *MessageHandler) GetMessageEdits(c *gin.Context) {
+	var req domain.GetMessageEditsReq
+	var ok bool
+	if req.ID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+
+	edits, err := h.MessageServicePort.GetMessageEdits(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, edits)
+}
+
+// AddReaction reacts to a message with the emoji in the path. Reacting twice is a no-op.
+func (h *MessageHandler) AddReaction(c *gin.Context) {
+	h.react(c, false)
+}
+
+// RemoveReaction takes back a reaction. Removing a reaction that is not there is a no-op.
+func (h *MessageHandler) RemoveReaction(c *gin.Context) {
+	h.react(c, true)
+}
+
+func (h *MessageHandler) react(c *gin.Context, remove bool) {
+	req := domain.ReactReq{Emoji: c.Param("emoji"), Remove: remove}
+	if !domain.ValidEmoji(req.Emoji) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("emoji must be at most %d bytes without spaces", domain.MaxEmojiLength)})
+		return
+	}
+
+	var ok bool
+	if req.MessageID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+
+	reaction, err := h.MessageServicePort.React(c.Request.Context(), &req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	h.hub.React(reaction, c.MustGet("username").(string))
+
+	c.JSON(http.StatusOK, reaction)
+}
+
+// GetThread returns a message with a page of its replies, paginated like GetMessages.
+func (h *MessageHandler) GetThread(c *gin.Context) {
+	roomID, err := strconv.ParseInt(c.Param("roomId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &domain.GetThreadReq{RoomID: roomID}
+	var ok bool
+	if req.MessageID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+	if before := c.Query("before"); before != "" {
+		req.Before, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a message id"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		req.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+			return
+		}
+	}
+
+	res, err := h.MessageServicePort.GetThread(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// GetMentions returns the messages mentioning the user, newest first. Older pages
+// are loaded with ?before=<nextBefore>.
+func (h *MessageHandler) GetMentions(c *gin.Context) {
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &domain.GetMentionsReq{UserID: clientID}
+	if before := c.Query("before"); before != "" {
+		req.Before, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a message id"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		req.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+			return
+		}
+	}
+
+	res, err := h.MessageServicePort.GetMentions(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// SearchMessages searches the messages of the rooms the user is a member of,
+// optionally narrowed to one room (?roomId=) or sender (?from=). Results are
+// newest first; older pages are loaded with ?before=<nextBefore>.
+func (h *MessageHandler) SearchMessages(c *gin.Context) {
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &domain.SearchMessagesReq{UserID: clientID, Query: strings.TrimSpace(c.Query("q"))}
+	if req.Query == "" || len(req.Query) > domain.MaxSearchLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("q must be between 1 and %d bytes", domain.MaxSearchLength)})
+		return
+	}
+	ids := []struct {
+		param string
+		dest  *int64
+		err   string
+	}{
+		{"roomId", &req.RoomID, "roomId must be a chatroom id"},
+		{"from", &req.FromID, "from must be a user id"},
+		{"before", &req.Before, "before must be a message id"},
+	}
+	for _, id := range ids {
+		if value := c.Query(id.param); value != "" {
+			*id.dest, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": id.err})
+				return
+			}
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		req.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+			return
+		}
+	}
+
+	res, err := h.MessageServicePort.SearchMessages(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// PinMessage pins a message to its room. Only moderators of the room may pin.
+func (h *MessageHandler) PinMessage(c *gin.Context) {
+	h.pin(c, false)
+}
+
+// UnpinMessage removes a pin. Only moderators of the room may unpin.
+func (h *MessageHandler) UnpinMessage(c *gin.Context) {
+	h.pin(c, true)
+}
+
+func (h *MessageHandler) pin(c *gin.Context, unpin bool) {
+	roomID, err := strconv.ParseInt(c.Param("roomId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &domain.PinReq{RoomID: roomID}
+	var ok bool
+	if req.MessageID, req.UserID, ok = messageRequest(c); !ok {
+		return
+	}
+
+	change, notify := h.MessageServicePort.PinMessage, h.hub.Pin
+	if unpin {
+		change, notify = h.MessageServicePort.UnpinMessage, h.hub.Unpin
+	}
+	pin, err := change(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	notify(pin, req.UserID, c.MustGet("username").(string))
+
+	c.JSON(http.StatusOK, pin)
+}
+
+// GetPins returns the pinned messages of a room, most recently pinned first.
+func (h *MessageHandler) GetPins(c *gin.Context) {
+	roomID, err := strconv.ParseInt(c.Param("roomId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pins, err := h.MessageServicePort.GetPins(c.Request.Context(), &domain.GetPinsReq{RoomID: roomID, UserID: clientID})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, pins)
+}
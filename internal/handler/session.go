@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"net/http"
+	"server/internal/domain"
+	"server/internal/port"
+	"server/internal/ws"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// refreshCookiePath limits the refresh token cookie to the requests that use it.
+const refreshCookiePath = "/token"
+
+type SessionHandler struct {
+	port.SessionServicePort
+	hub *ws.Hub
+}
+
+func NewSessionHandler(s port.SessionServicePort, hub *ws.Hub) *SessionHandler {
+	return &SessionHandler{s, hub}
+}
+
+// Refresh exchanges the refresh token from the body, or else from the
+// refresh_token cookie, for new tokens. A refresh token works only once.
+func (h *SessionHandler) Refresh(c *gin.Context) {
+	var req domain.RefreshTokenReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		req.RefreshToken, _ = c.Cookie("refresh_token")
+	}
+	if req.RefreshToken == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "no refresh token"})
+		return
+	}
+
+	res, err := h.SessionServicePort.Refresh(c.Request.Context(), req.RefreshToken)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	setAuthCookies(c, res)
+	c.JSON(http.StatusOK, res)
+}
+
+// Logout revokes the session of the access token, so neither it nor the
+// session's refresh token are accepted any more.
+func (h *SessionHandler) Logout(c *gin.Context) {
+	userID, sessionID, ok := sessionRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := h.SessionServicePort.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	h.hub.RevokeSessions(userID, []int64{sessionID})
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "logout successful"})
+}
+
+// GetSessions lists the devices the user is signed in on. The session of the
+// request is marked current.
+func (h *SessionHandler) GetSessions(c *gin.Context) {
+	userID, sessionID, ok := sessionRequest(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := h.SessionServicePort.GetSessions(c.Request.Context(), userID, sessionID)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs the user out of one session and closes the WebSocket
+// connections opened with it.
+func (h *SessionHandler) RevokeSession(c *gin.Context) {
+	userID, current, ok := sessionRequest(c)
+	if !ok {
+		return
+	}
+	sessionID, err := strconv.ParseInt(c.Param("sessionId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.SessionServicePort.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	h.hub.RevokeSessions(userID, []int64{sessionID})
+
+	if sessionID == current {
+		clearAuthCookies(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// RevokeSessions signs the user out everywhere, this session included.
+func (h *SessionHandler) RevokeSessions(c *gin.Context) {
+	userID, _, ok := sessionRequest(c)
+	if !ok {
+		return
+	}
+
+	ids, err := h.SessionServicePort.RevokeSessions(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	h.hub.RevokeSessions(userID, ids)
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "all sessions revoked", "revoked": ids})
+}
+
+// sessionRequest reads the user and session of an authenticated request.
+func sessionRequest(c *gin.Context) (userID int64, sessionID int64, ok bool) {
+	userID, err := strconv.ParseInt(c.MustGet("userID").(string), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, 0, false
+	}
+	return userID, c.MustGet("sessionID").(int64), true
+}
+
+func setAuthCookies(c *gin.Context, res *domain.LoginUserRes) {
+	// The jwt cookie authenticates requests, so other sites must not be able to send it
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("jwt", res.AccessToken, int(time.Until(res.ExpiresAt).Seconds()), "/", "localhost", false, true)
+	c.SetCookie("refresh_token", res.RefreshToken, int(time.Until(res.RefreshExpiresAt).Seconds()), refreshCookiePath, "localhost", false, true)
+}
+
+func clearAuthCookies(c *gin.Context) {
+	c.SetCookie("jwt", "", -1, "/", "localhost", false, true)
+	c.SetCookie("refresh_token", "", -1, refreshCookiePath, "localhost", false, true)
+}
@@ -40,6 +40,13 @@ func (h *UserHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if user.DeviceLabel == "" {
+		user.DeviceLabel = deviceLabel(c)
+	}
+	if len(user.DeviceLabel) > maxDeviceLabelLength {
+		user.DeviceLabel = user.DeviceLabel[:maxDeviceLabelLength]
+	}
+	user.IP, user.UserAgent = c.ClientIP(), c.Request.UserAgent()
 
 	u, err := h.UserServicePort.Login(c.Request.Context(), &user)
 	if err != nil {
@@ -47,20 +54,19 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
-	c.SetCookie("jwt", u.AccessToken, 60*60*24, "/", "localhost", false, true)
+	setAuthCookies(c, u)
 	res := &domain.LoginUserRes{
-		AccessToken: u.AccessToken,
-		ID:          u.ID,
-		Username:    u.Username,
+		AccessToken:      u.AccessToken,
+		ExpiresAt:        u.ExpiresAt,
+		RefreshToken:     u.RefreshToken,
+		RefreshExpiresAt: u.RefreshExpiresAt,
+		ID:               u.ID,
+		Username:         u.Username,
+		Role:             u.Role,
 	}
 	c.JSON(http.StatusOK, res)
 }
 
-func (h *UserHandler) Logout(c *gin.Context) {
-	c.SetCookie("jwt", "", -1, "", "", false, true)
-	c.JSON(http.StatusOK, gin.H{"message": "logout successful"})
-}
-
 func (h *UserHandler) UpdateUsername(c *gin.Context) {
 	var u domain.UpdateUsernameReq
 
@@ -123,6 +129,29 @@ func (h *UserHandler) GetAllUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
+// UpdateRole sets the role of the user :userId.
+func (h *UserHandler) UpdateRole(c *gin.Context) {
+	var req domain.UpdateRoleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.ID = id
+
+	if err := h.UserServicePort.UpdateRole(c.Request.Context(), &req); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "role updated successfully"})
+}
+
 func (h *UserHandler) DeleteAllUsers(c *gin.Context) {
 	if err := h.UserServicePort.DeleteAllUsers(c.Request.Context()); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -2,26 +2,35 @@ package handler
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"server/internal/domain"
+	"server/internal/middleware"
 	"server/internal/port"
-	"server/internal/service"
 	"server/internal/ws"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/websocket"
 )
 
 type WSHandler struct {
-	hub *ws.Hub
+	hub      *ws.Hub
+	sessions port.SessionServicePort
+	upgrader websocket.Upgrader
 	port.ChatroomServicePort
 }
 
-func NewWSHandler(hub *ws.Hub, s port.ChatroomServicePort) *WSHandler {
+func NewWSHandler(hub *ws.Hub, s port.ChatroomServicePort, sessions port.SessionServicePort) *WSHandler {
 	return &WSHandler{
-		hub:                 hub,
+		hub:      hub,
+		sessions: sessions,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     hub.CheckOrigin,
+		},
 		ChatroomServicePort: s,
 	}
 }
@@ -37,17 +46,21 @@ func (h *WSHandler) CreateRoom(c *gin.Context) {
 		return
 	}
 
+	userID := c.MustGet("userID").(string)
+	clientID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.CreatorID = clientID // The creator moderates the room
+
 	res, err := h.ChatroomServicePort.CreateChatroom(c.Request.Context(), req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	h.hub.Rooms[res.ID] = &ws.Room{
-		ID:      res.ID,
-		Name:    res.Name,
-		Clients: make(map[int64]*ws.Client),
-	}
+	h.hub.AddRoom(res.ID, res.Name)
 
 	c.JSON(http.StatusCreated, &domain.Chatroom{
 		ID:       res.ID,
@@ -82,11 +95,7 @@ func (h *WSHandler) CreateDM(c *gin.Context) {
 		return
 	}
 
-	h.hub.Rooms[res.ID] = &ws.Room{
-		ID:      res.ID,
-		Name:    res.Name,
-		Clients: make(map[int64]*ws.Client),
-	}
+	h.hub.AddRoom(res.ID, res.Name)
 
 	c.JSON(http.StatusCreated, &domain.CreateDMRes{
 		ID:       res.ID,
@@ -97,32 +106,64 @@ func (h *WSHandler) CreateDM(c *gin.Context) {
 
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// Ticket issues a single-use ticket for opening a WebSocket connection with
+// ?ticket=, for clients that can send neither the jwt cookie nor a header.
+func (h *WSHandler) Ticket(c *gin.Context) {
+	ticket, err := h.sessions.IssueTicket(c.Request.Context(), c.MustGet("sessionID").(int64))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, ticket)
 }
 
-func (h *WSHandler) JoinRoom(c *gin.Context) {
-
-	// check authorization
-	tokenString := c.GetHeader("Sec-Websocket-Protocol")
-	fmt.Println("tokenString: ", tokenString)
-	if tokenString == "" {
-		fmt.Println("unauthorized: no token")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+// authorizeWS authenticates a handshake with a ?ticket=, else the access token
+// of the Authorization header or jwt cookie, and sets userID, username and
+// sessionID on the context. Handshakes from origins that are not allowed are refused.
+func (h *WSHandler) authorizeWS(c *gin.Context) bool {
+	if !h.upgrader.CheckOrigin(c.Request) {
+		log.Printf("refused WebSocket handshake from origin %q", c.GetHeader("Origin"))
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+		return false
 	}
 
-	token, err := service.JWTAuthService().ValidateToken(tokenString)
-	if token.Valid {
-		c.Set("userID", token.Claims.(jwt.MapClaims)["id"])
-		c.Set("username", token.Claims.(jwt.MapClaims)["username"])
+	var claims *domain.TokenClaims
+	var err error
+	if ticket := c.Query("ticket"); ticket != "" {
+		claims, err = h.sessions.RedeemTicket(c.Request.Context(), ticket)
 	} else {
+		var tokenString string
+		tokenString, err = middleware.AccessToken(c)
+		if err == nil {
+			claims, err = h.sessions.Authenticate(c.Request.Context(), tokenString)
+		}
+	}
+	if err != nil {
 		fmt.Println("unauthorized err: ", err)
 		c.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	}
+	c.Set("userID", strconv.FormatInt(claims.UserID, 10))
+	c.Set("username", claims.Username)
+	c.Set("sessionID", claims.SessionID)
+	c.Set("role", claims.Role)
+	return true
+}
+
+// Connect opens a WebSocket connection that is not subscribed to any room yet.
+// Rooms are added and removed with the subscribe and unsubscribe ops.
+func (h *WSHandler) Connect(c *gin.Context) {
+	if !h.authorizeWS(c) {
+		return
+	}
+	h.serveWS(c, 0, -1)
+}
+
+// JoinRoom opens a WebSocket connection subscribed to roomId.
+// More rooms can be added over the same connection with the subscribe op.
+// A client reconnecting passes ?since=<seq> to have the messages it missed replayed.
+func (h *WSHandler) JoinRoom(c *gin.Context) {
+	if !h.authorizeWS(c) {
 		return
 	}
 
@@ -131,7 +172,21 @@ func (h *WSHandler) JoinRoom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	since := int64(-1)
+	if s := c.Query("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a sequence number"})
+			return
+		}
+	}
+	h.serveWS(c, roomID, since)
+}
 
+// serveWS upgrades the connection and runs the client until it disconnects.
+// If roomID is not 0 the client is joined and subscribed to it first, resuming
+// after since unless it is negative.
+func (h *WSHandler) serveWS(c *gin.Context, roomID int64, since int64) {
 	userID := c.MustGet("userID").(string)
 	clientID, err := strconv.ParseInt(userID, 10, 64)
 	if err != nil {
@@ -140,58 +195,39 @@ func (h *WSHandler) JoinRoom(c *gin.Context) {
 	}
 	username := c.MustGet("username").(string)
 
-	res, err := h.ChatroomServicePort.JoinChatroom(c.Request.Context(), &domain.JoinLeaveChatroomReq{
-		ID:       roomID,
-		ClientID: clientID,
-	})
-
-	if err != nil {
-		fmt.Println("err: ", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if roomID != 0 {
+		res, err := h.ChatroomServicePort.JoinChatroom(c.Request.Context(), &domain.JoinLeaveChatroomReq{
+			ID:       roomID,
+			ClientID: clientID,
+		})
+		if err != nil {
+			fmt.Println("err: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.hub.AddRoom(roomID, res.Name)
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, http.Header{
-		"Sec-websocket-Protocol": websocket.Subprotocols(c.Request),
-	})
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	client := &ws.Client{
-		Conn:     conn,
-		Message:  make(chan *ws.Message),
-		ID:       clientID,
-		RoomID:   roomID,
-		Username: username,
-	}
-
-	message := &ws.Message{
-		Content:  fmt.Sprintf("%s has joined the room", username),
-		RoomID:   roomID,
-		Username: username,
-		SenderID: clientID,
-		Type:     ws.Normal,
-	}
+	client := h.hub.NewClient(conn, clientID, username, deviceLabel(c))
+	client.AuthSessionID = c.MustGet("sessionID").(int64)
+	// The writer must be running before the hub sends anything to the client
+	go client.WriteMessage(h.hub)
 
-	if _, ok := h.hub.Rooms[roomID]; !ok {
-		h.hub.Rooms[roomID] = &ws.Room{
-			ID:      roomID,
-			Name:    res.Name,
-			Clients: make(map[int64]*ws.Client),
-		}
+	// Register a new client with the hub
+	h.hub.Register(client)
+	if roomID != 0 && since >= 0 {
+		h.hub.Resume(client, roomID, since)
+	} else if roomID != 0 {
+		// Subscribing broadcasts a join message to all clients in the room
+		h.hub.Subscribe(client, roomID)
 	}
 
-	h.hub.ConnectionMap[client.ID] = client.Conn
-	h.hub.BroadcastMap[client.ID] = client.Message
-
-	// Register a new client through the register channel
-	h.hub.Register <- client
-	// Broadcast the message to all clients in the room
-	h.hub.Broadcast <- message
-
-	go client.WriteMessage(h.hub)
 	client.ReadMessage(h.hub)
 }
 
@@ -208,7 +244,6 @@ func (h *WSHandler) LeaveRoom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	username := c.MustGet("username").(string)
 
 	err = h.ChatroomServicePort.LeaveChatroom(c.Request.Context(), &domain.JoinLeaveChatroomReq{
 		ID:       roomID,
@@ -219,41 +254,73 @@ func (h *WSHandler) LeaveRoom(c *gin.Context) {
 		return
 	}
 
-	go ws.LeaveChatroom(h.hub)
-
-	h.hub.LeaveRoom <- &ws.Client{
-		Conn:     h.hub.ConnectionMap[clientID],
-		Message:  h.hub.BroadcastMap[clientID],
-		ID:       clientID,
-		RoomID:   roomID,
-		Username: username,
-	}
+	h.hub.LeaveRoom(roomID, clientID)
 
 	c.JSON(http.StatusOK, nil)
 }
 
+// GetRooms lists the public rooms, filtered by ?q= (part of the name) and
+// ?joined=true|false, in ?sort=name|members|activity order. The cursor of the
+// next page is returned in the X-Next-Cursor header and passed back as ?cursor=.
 func (h *WSHandler) GetRooms(c *gin.Context) {
 	rooms := make([]domain.Chatroom, 0)
 
 	userID := c.MustGet("userID").(string)
 	userIDInt, err := strconv.ParseInt(userID, 10, 64)
-	arr, err := h.ChatroomServicePort.GetAllChatrooms(c.Request.Context(), userIDInt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, res := range arr {
+	req := &domain.GetRoomsReq{UserID: userIDInt, Search: strings.TrimSpace(c.Query("q")), Sort: c.Query("sort")}
+	if len(req.Search) > domain.MaxRoomSearch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("q must be at most %d bytes", domain.MaxRoomSearch)})
+		return
+	}
+	switch req.Sort {
+	case "", domain.RoomSortName, domain.RoomSortMembers, domain.RoomSortActivity:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be name, members or activity"})
+		return
+	}
+	if joined := c.Query("joined"); joined != "" {
+		j, err := strconv.ParseBool(joined)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "joined must be true or false"})
 			return
 		}
-		rooms = append(rooms, domain.Chatroom{
-			ID:       res.ID,
-			Name:     res.Name,
-			Clients:  res.Clients,
-			Category: res.Category,
-		})
+		req.Joined = &j
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		req.After, err = domain.ParseRoomCursor(cursor)
+		sort := req.Sort
+		if sort == "" {
+			sort = domain.RoomSortName
+		}
+		if err != nil || req.After.Sort != sort {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor is not from a page in this order"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		req.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+			return
+		}
+	}
+
+	res, err := h.ChatroomServicePort.GetAllChatrooms(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, room := range res.Rooms {
+		rooms = append(rooms, *room)
+	}
+	if res.NextCursor != "" {
+		c.Header("X-Next-Cursor", res.NextCursor)
 	}
 	c.JSON(http.StatusOK, rooms)
 }
@@ -275,18 +342,55 @@ func (h *WSHandler) GetDMs(c *gin.Context) {
 			return
 		}
 		rooms = append(rooms, domain.Chatroom{
-			ID:       res.ID,
-			Name:     res.Name,
-			Clients:  res.Clients,
-			Category: res.Category,
+			ID:             res.ID,
+			Name:           res.Name,
+			Clients:        res.Clients,
+			Category:       res.Category,
+			UnreadCount:    res.UnreadCount,
+			LastMessage:    res.LastMessage,
+			MemberCount:    res.MemberCount,
+			LastActivityAt: res.LastActivityAt,
 		})
 	}
 	c.JSON(http.StatusOK, rooms)
 }
 
+// GetPresence returns whether the user is online on any instance, or when they were last seen.
+func (h *WSHandler) GetPresence(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	presence, err := h.hub.Presence(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
+
+const maxDeviceLabelLength = 64
+
+// deviceLabel names the device a connection comes from, using the device query
+// parameter when the client sends one and the User-Agent otherwise.
+func deviceLabel(c *gin.Context) string {
+	label := c.Query("device")
+	if label == "" {
+		label = c.Request.UserAgent()
+	}
+	if len(label) > maxDeviceLabelLength {
+		label = label[:maxDeviceLabelLength]
+	}
+	return label
+}
+
 type ClientRes struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
+	ID       int64           `json:"id"`
+	Username string          `json:"username"`
+	Devices  []ws.DeviceInfo `json:"devices"`
 }
 
 func (h *WSHandler) GetOnlineClientsInRoom(c *gin.Context) {
@@ -297,15 +401,13 @@ func (h *WSHandler) GetOnlineClientsInRoom(c *gin.Context) {
 		return
 	}
 
-	if _, ok := h.hub.Rooms[roomID]; !ok || h.hub.Rooms[roomID] == nil {
-		clients = make([]ClientRes, 0)
-	} else {
-		for _, c := range h.hub.Rooms[roomID].Clients {
-			clients = append(clients, ClientRes{
-				ID:       c.ID,
-				Username: c.Username,
-			})
-		}
+	clients = make([]ClientRes, 0)
+	for _, c := range h.hub.OnlineClients(roomID) {
+		clients = append(clients, ClientRes{
+			ID:       c.ID,
+			Username: c.Username,
+			Devices:  c.Devices,
+		})
 	}
 
 	c.JSON(http.StatusOK, clients)
@@ -337,4 +439,9 @@ func (h *WSHandler) UpdateRoom(c *gin.Context) {
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "room updated successfully"})
-}
\ No newline at end of file
+}
+
+// GetQueueStats reports how full the send queues of this instance's connections are.
+func (h *WSHandler) GetQueueStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.hub.QueueStats())
+}
@@ -1,40 +1,69 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"server/internal/service"
+	"server/internal/domain"
+	"server/internal/port"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 )
 
-func AuthorizeJWT() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if len(authHeader) == 0 {
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
+// ErrNoToken is returned by AccessToken when the request carries no token.
+var ErrNoToken = errors.New("no access token")
 
+// AccessToken returns the access token of a request, taken from the
+// Authorization bearer header or, when there is none, the jwt cookie.
+func AccessToken(c *gin.Context) (string, error) {
+	if authHeader := c.GetHeader("Authorization"); authHeader != "" {
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			return "", errors.New("authorization header is not a bearer token")
+		}
+		return parts[1], nil
+	}
+	if cookie, err := c.Cookie("jwt"); err == nil && cookie != "" {
+		return cookie, nil
+	}
+	return "", ErrNoToken
+}
+
+// AuthorizeJWT lets requests through with an access token of a live session,
+// setting userID, username and sessionID on the context.
+func AuthorizeJWT(sessions port.SessionServicePort) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := AccessToken(c)
+		if err != nil {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
-		tokenString := parts[1]
-		token, err := service.JWTAuthService().ValidateToken(tokenString)
-		
-		if token.Valid {
-			c.Set("userID", token.Claims.(jwt.MapClaims)["id"])
-			c.Set("username", token.Claims.(jwt.MapClaims)["username"])
-			c.Next()
-		} else {
+		claims, err := sessions.Authenticate(c.Request.Context(), tokenString)
+		if err != nil {
 			fmt.Println("unauthorized: ", err)
 			c.AbortWithStatus(http.StatusUnauthorized)
+			return
 		}
 
+		c.Set("userID", strconv.FormatInt(claims.UserID, 10))
+		c.Set("username", claims.Username)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("role", claims.Role)
+		c.Next()
+	}
+}
+
+// RequirePermission lets through requests of users whose role has the
+// permission. It must come after AuthorizeJWT.
+func RequirePermission(p domain.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !domain.RoleCan(c.GetString("role"), p) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
 	}
 }
@@ -3,6 +3,7 @@ package port
 import (
 	"context"
 	"server/internal/domain"
+	"time"
 )
 
 type UserRepoPort interface {
@@ -13,6 +14,23 @@ type UserRepoPort interface {
 	UpdatePassword(ctx context.Context, id int64, password string) error
 	GetAllUsers(ctx context.Context) ([]*domain.PublicUser, error)
 	DeleteAllUsers(ctx context.Context) error
+	UpdateRole(ctx context.Context, id int64, role string) error
+	PromoteFirstAdmin(ctx context.Context, email string) (bool, error)
+	GetRole(ctx context.Context, id int64) (string, error)
+	UpdateLastSeen(ctx context.Context, id int64, at time.Time) error
+	GetLastSeen(ctx context.Context, id int64) (*time.Time, error)
+}
+
+type SessionRepoPort interface {
+	CreateSession(ctx context.Context, session *domain.Session, tokenHash []byte, expiresAt time.Time) (*domain.Session, error)
+	RotateRefreshToken(ctx context.Context, tokenHash, newHash []byte, expiresAt time.Time) (*domain.Session, error)
+	GetSession(ctx context.Context, id int64) (*domain.Session, error)
+	GetSessions(ctx context.Context, userID int64) ([]*domain.Session, error)
+	RevokeSession(ctx context.Context, userID, id int64) error
+	RevokeSessions(ctx context.Context, userID int64) ([]int64, error)
+	CreateTicket(ctx context.Context, sessionID int64, ticketHash []byte, expiresAt time.Time) error
+	RedeemTicket(ctx context.Context, ticketHash []byte) (*domain.Session, error)
+	DeleteSessionAll(ctx context.Context) error
 }
 
 type ChatroomRepoPort interface {
@@ -22,7 +40,29 @@ type ChatroomRepoPort interface {
 	LeaveChatroom(ctx context.Context, id int64, clientID int64) error
 	GetChatroomByID(ctx context.Context, roomId int64) (*domain.GetRoomByIDRepo, error)
 	UpdateChatroomName(ctx context.Context, id int64, name string) error
-	GetAllChatrooms(ctx context.Context, userID int64) ([]*domain.Chatroom, error)
+	GetAllChatrooms(ctx context.Context, req *domain.GetRoomsReq) ([]*domain.Chatroom, error)
 	GetAllDMs(ctx context.Context, userID int64) ([]*domain.Chatroom, error)
+	GetContacts(ctx context.Context, userID int64) ([]int64, error)
 	DeleteChatroomAll(ctx context.Context) error
 }
+
+type MessageRepoPort interface {
+	CreateMessage(ctx context.Context, message *domain.ChatMessage) (*domain.ChatMessage, error)
+	GetMessageByID(ctx context.Context, id int64) (*domain.ChatMessage, error)
+	GetMessagesByRoom(ctx context.Context, roomID int64, before int64, limit int) ([]*domain.ChatMessage, error)
+	GetMessagesSince(ctx context.Context, roomID int64, since int64, limit int) ([]*domain.ChatMessage, error)
+	GetReplies(ctx context.Context, parentID int64, before int64, limit int) ([]*domain.ChatMessage, error)
+	GetMentions(ctx context.Context, userID int64, before int64, limit int) ([]*domain.ChatMessage, error)
+	PinMessage(ctx context.Context, roomID int64, messageID int64, userID int64) (*domain.Pin, error)
+	UnpinMessage(ctx context.Context, roomID int64, messageID int64) (*domain.Pin, error)
+	GetPins(ctx context.Context, roomID int64) ([]*domain.Pin, error)
+	SearchMessages(ctx context.Context, req *domain.SearchMessagesReq) ([]*domain.SearchResult, error)
+	MarkRead(ctx context.Context, userID int64, roomID int64, seq int64) (*domain.ReadReceipt, error)
+	EditMessage(ctx context.Context, id int64, editorID int64, content string) (*domain.ChatMessage, error)
+	DeleteMessage(ctx context.Context, id int64) (*domain.ChatMessage, error)
+	GetMessageEdits(ctx context.Context, id int64) ([]*domain.MessageEdit, error)
+	AddReaction(ctx context.Context, messageID int64, userID int64, emoji string) (*domain.Reaction, error)
+	RemoveReaction(ctx context.Context, messageID int64, userID int64, emoji string) (*domain.Reaction, error)
+	GetReactions(ctx context.Context, messageIDs []int64) (map[int64][]*domain.ReactionCount, error)
+	DeleteMessageAll(ctx context.Context) error
+}
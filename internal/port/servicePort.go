@@ -3,6 +3,7 @@ package port
 import (
 	"context"
 	"server/internal/domain"
+	"time"
 )
 
 type UserServicePort interface {
@@ -12,6 +13,26 @@ type UserServicePort interface {
 	UpdatePassword(ctx context.Context, req *domain.UpdatePasswordReq) error
 	GetAllUsers(ctx context.Context) ([]*domain.PublicUser, error)
 	DeleteAllUsers(ctx context.Context) error
+	UpdateRole(ctx context.Context, req *domain.UpdateRoleReq) error
+	BootstrapAdmin(ctx context.Context, email string) (bool, error)
+}
+
+// TokenServicePort issues and checks the access tokens of logged in users.
+type TokenServicePort interface {
+	GenerateToken(user *domain.User, sessionID int64) (string, *domain.TokenClaims, error)
+	ValidateToken(token string) (*domain.TokenClaims, error)
+}
+
+// SessionServicePort starts, refreshes and revokes login sessions.
+type SessionServicePort interface {
+	Start(ctx context.Context, user *domain.User, device *domain.Session) (*domain.LoginUserRes, error)
+	Refresh(ctx context.Context, refreshToken string) (*domain.LoginUserRes, error)
+	Authenticate(ctx context.Context, accessToken string) (*domain.TokenClaims, error)
+	GetSessions(ctx context.Context, userID, currentID int64) ([]*domain.Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID int64) error
+	RevokeSessions(ctx context.Context, userID int64) ([]int64, error)
+	IssueTicket(ctx context.Context, sessionID int64) (*domain.WSTicket, error)
+	RedeemTicket(ctx context.Context, ticket string) (*domain.TokenClaims, error)
 }
 
 type ChatroomServicePort interface {
@@ -21,7 +42,31 @@ type ChatroomServicePort interface {
 	LeaveChatroom(ctx context.Context, req *domain.JoinLeaveChatroomReq) error
 	GetChatroomByID(ctx context.Context, req *domain.GetChatroomByIDReq) (*domain.GetChatroomByIDRes, error)
 	UpdateChatroomName(ctx context.Context, req *domain.UpdateChatroomNameReq) error
-	GetAllChatrooms(ctx context.Context, userID int64) ([]*domain.Chatroom, error)
+	GetAllChatrooms(ctx context.Context, req *domain.GetRoomsReq) (*domain.GetRoomsRes, error)
 	GetAllDMs(ctx context.Context, userID int64) ([]*domain.Chatroom, error)
 	DeleteAllRooms(ctx context.Context) error
 }
+
+type PresenceServicePort interface {
+	GetContacts(ctx context.Context, userID int64) ([]int64, error)
+	UpdateLastSeen(ctx context.Context, userID int64, at time.Time) error
+	GetLastSeen(ctx context.Context, userID int64) (*time.Time, error)
+}
+
+type MessageServicePort interface {
+	SaveMessage(ctx context.Context, message *domain.ChatMessage) (*domain.ChatMessage, error)
+	GetMessage(ctx context.Context, id int64) (*domain.ChatMessage, error)
+	GetMessages(ctx context.Context, req *domain.GetMessagesReq) (*domain.GetMessagesRes, error)
+	GetMessagesSince(ctx context.Context, roomID int64, since int64, limit int) ([]*domain.ChatMessage, error)
+	MarkRead(ctx context.Context, req *domain.MarkReadReq) (*domain.ReadReceipt, error)
+	EditMessage(ctx context.Context, req *domain.EditMessageReq) (*domain.ChatMessage, error)
+	DeleteMessage(ctx context.Context, req *domain.DeleteMessageReq) (*domain.ChatMessage, error)
+	GetMessageEdits(ctx context.Context, req *domain.GetMessageEditsReq) ([]*domain.MessageEdit, error)
+	React(ctx context.Context, req *domain.ReactReq) (*domain.Reaction, error)
+	GetThread(ctx context.Context, req *domain.GetThreadReq) (*domain.GetThreadRes, error)
+	GetMentions(ctx context.Context, req *domain.GetMentionsReq) (*domain.GetMentionsRes, error)
+	SearchMessages(ctx context.Context, req *domain.SearchMessagesReq) (*domain.SearchMessagesRes, error)
+	PinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error)
+	UnpinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error)
+	GetPins(ctx context.Context, req *domain.GetPinsReq) ([]*domain.Pin, error)
+}
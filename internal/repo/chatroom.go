@@ -7,6 +7,7 @@ import (
 	"server/internal/domain"
 	"server/internal/port"
 	"server/util"
+	"strings"
 
 	"github.com/lib/pq"
 )
@@ -37,9 +38,9 @@ func (r *repository) CreateChatroom(ctx context.Context, chatroom *domain.Chatro
 		return &domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
 	}
 
-	query := "INSERT INTO chatrooms (name, category) VALUES ($1, $2) RETURNING id"
+	query := "INSERT INTO chatrooms (name, category, moderators) VALUES ($1, $2, COALESCE($3::bigint[], array[]::BIGINT[])) RETURNING id"
 	var id int64
-	err = r.db.QueryRowContext(ctx, query, chatroom.Name, domain.Public).Scan(&id)
+	err = r.db.QueryRowContext(ctx, query, chatroom.Name, domain.Public, pq.Array(chatroom.Moderators)).Scan(&id)
 	if err != nil {
 		return &domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
 	}
@@ -172,7 +173,7 @@ func (r *repository) LeaveChatroom(ctx context.Context, id int64, clientID int64
 }
 
 func (r *repository) GetChatroomByID(ctx context.Context, roomId int64) (*domain.GetRoomByIDRepo, error) {
-	query := `SELECT chatrooms.id, name as roomName, category, clients, users.id as userId, username, email
+	query := `SELECT chatrooms.id, name as roomName, category, clients, COALESCE(moderators, array[]::BIGINT[]), users.id as userId, username, email
 				FROM chatrooms LEFT JOIN users ON users.id = ANY (chatrooms.clients) 
 				WHERE chatrooms.id = $1 
 				ORDER BY users.id;`
@@ -188,12 +189,13 @@ func (r *repository) GetChatroomByID(ctx context.Context, roomId int64) (*domain
 		var username sql.NullString
 		var email sql.NullString
 		var chatroomTmp domain.Chatroom
-		err = rows.Scan(&chatroomTmp.ID, &chatroomTmp.Name, &chatroomTmp.Category, pq.Array(&chatroomTmp.Clients), &userid, &username, &email)
+		err = rows.Scan(&chatroomTmp.ID, &chatroomTmp.Name, &chatroomTmp.Category, pq.Array(&chatroomTmp.Clients), pq.Array(&chatroomTmp.Moderators), &userid, &username, &email)
 
 		if userid.Valid {
 			chatroomByID.ID = chatroomTmp.ID
 			chatroomByID.Name = chatroomTmp.Name
 			chatroomByID.Category = chatroomTmp.Category
+			chatroomByID.Moderators = chatroomTmp.Moderators
 			clients = append(clients, domain.PublicUser{
 				ID:       userid.Int64,
 				Username: username.String,
@@ -203,6 +205,7 @@ func (r *repository) GetChatroomByID(ctx context.Context, roomId int64) (*domain
 			chatroomByID.ID = chatroomTmp.ID
 			chatroomByID.Name = chatroomTmp.Name
 			chatroomByID.Category = chatroomTmp.Category
+			chatroomByID.Moderators = chatroomTmp.Moderators
 		}
 
 		if err != nil {
@@ -219,6 +222,11 @@ func (r *repository) GetChatroomByID(ctx context.Context, roomId int64) (*domain
 		return &domain.GetRoomByIDRepo{}, domain.ErrInternal.From(err.Error(), err)
 	}
 
+	chatroomByID.Pins, err = queryPins(ctx, r.db, "WHERE room_pins.room_id = $1", roomId)
+	if err != nil {
+		return &domain.GetRoomByIDRepo{}, err
+	}
+
 	return &chatroomByID, nil
 }
 
@@ -235,42 +243,148 @@ func (r *repository) UpdateChatroomName(ctx context.Context, id int64, name stri
 	return nil
 }
 
-func (r *repository) GetAllChatrooms(ctx context.Context, userID int64) ([]*domain.Chatroom, error) {
-	query := "SELECT id, name, clients, category FROM chatrooms where category = 'public'"
-	rows, err := r.db.QueryContext(ctx, query)
-	if err != nil {
-		return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
+// roomSummaryQuery selects rooms with the unread count of user $1 and the latest
+// message. Unread messages are only counted in rooms the user is a member of.
+const roomSummaryQuery = `
+	SELECT chatrooms.id, chatrooms.name, chatrooms.clients, chatrooms.category,
+		cardinality(chatrooms.clients), chatrooms.last_activity_at,
+		CASE WHEN chatrooms.clients @> ARRAY[$1::bigint] THEN (
+			SELECT count(*) FROM chat_messages
+			WHERE chat_messages.room_id = chatrooms.id AND chat_messages.sender_id <> $1
+				AND chat_messages.seq > COALESCE(room_reads.last_read_seq, 0)
+				AND NOT chat_messages.announcement
+		) ELSE 0 END AS unread_count,
+		last_message.id, last_message.sender_id, users.username, last_message.content,
+		last_message.type, last_message.seq, last_message.created_at
+	FROM chatrooms
+	LEFT JOIN room_reads ON room_reads.room_id = chatrooms.id AND room_reads.user_id = $1
+	LEFT JOIN LATERAL (
+		SELECT * FROM chat_messages
+		WHERE chat_messages.room_id = chatrooms.id AND chat_messages.deleted_at IS NULL AND chat_messages.parent_id IS NULL
+		ORDER BY seq DESC LIMIT 1
+	) AS last_message ON true
+	LEFT JOIN users ON users.id = last_message.sender_id
+`
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// GetAllChatrooms returns a page of the public rooms. Each order ends with the
+// room ID so that the rooms after req.After can be found from the cursor alone.
+func (r *repository) GetAllChatrooms(ctx context.Context, req *domain.GetRoomsReq) ([]*domain.Chatroom, error) {
+	args := []interface{}{req.UserID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
 	}
 
-	var chatrooms []*domain.Chatroom
-	for rows.Next() {
-		var chatroom domain.Chatroom
-		err = rows.Scan(&chatroom.ID, &chatroom.Name, pq.Array(&chatroom.Clients), &chatroom.Category)
-		if err != nil {
-			return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
+	where := []string{"chatrooms.category = 'public'"}
+	if req.Search != "" {
+		where = append(where, "chatrooms.name ILIKE "+arg("%"+likeEscaper.Replace(req.Search)+"%"))
+	}
+	if req.Joined != nil {
+		joined := "chatrooms.clients @> ARRAY[$1::bigint]"
+		if !*req.Joined {
+			joined = "NOT " + joined
 		}
+		where = append(where, joined)
+	}
 
-		chatrooms = append(chatrooms, &chatroom)
+	var order string
+	switch req.Sort {
+	case domain.RoomSortMembers:
+		order = "cardinality(chatrooms.clients) DESC, chatrooms.id DESC"
+		if req.After != nil {
+			where = append(where, fmt.Sprintf("(cardinality(chatrooms.clients), chatrooms.id) < (%s, %s)", arg(req.After.MemberCount), arg(req.After.ID)))
+		}
+	case domain.RoomSortActivity:
+		order = "chatrooms.last_activity_at DESC, chatrooms.id DESC"
+		if req.After != nil {
+			where = append(where, fmt.Sprintf("(chatrooms.last_activity_at, chatrooms.id) < (%s, %s)", arg(req.After.LastActivity), arg(req.After.ID)))
+		}
+	default:
+		order = "chatrooms.name, chatrooms.id"
+		if req.After != nil {
+			where = append(where, fmt.Sprintf("(chatrooms.name, chatrooms.id) > (%s, %s)", arg(req.After.Name), arg(req.After.ID)))
+		}
 	}
-	return chatrooms, nil
+
+	query := roomSummaryQuery + "WHERE " + strings.Join(where, " AND ") + " ORDER BY " + order + " LIMIT " + arg(req.Limit)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	return scanRoomSummaries(rows)
 }
 
 func (r *repository) GetAllDMs(ctx context.Context, userID int64) ([]*domain.Chatroom, error) {
-	query := "SELECT id, name, clients, category FROM chatrooms where category = 'private' AND $1 = ANY(clients)"
+	query := roomSummaryQuery + "WHERE chatrooms.category = 'private' AND chatrooms.clients @> ARRAY[$1::bigint] ORDER BY chatrooms.id"
 	rows, err := r.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
 	}
+	defer rows.Close()
+
+	return scanRoomSummaries(rows)
+}
+
+// GetContacts returns the users who share a room or DM with the user, including the user.
+func (r *repository) GetContacts(ctx context.Context, userID int64) ([]int64, error) {
+	query := "SELECT DISTINCT unnest(clients) AS id FROM chatrooms WHERE clients @> ARRAY[$1::bigint] ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
 
+	contacts := []int64{}
+	seen := false
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		seen = seen || id == userID
+		contacts = append(contacts, id)
+	}
+	if !seen {
+		contacts = append(contacts, userID)
+	}
+	return contacts, nil
+}
+
+func scanRoomSummaries(rows *sql.Rows) ([]*domain.Chatroom, error) {
 	var chatrooms []*domain.Chatroom
 	for rows.Next() {
 		var chatroom domain.Chatroom
-		err = rows.Scan(&chatroom.ID, &chatroom.Name, pq.Array(&chatroom.Clients), &chatroom.Category)
+		var id, senderID, typ, seq sql.NullInt64
+		var username, content sql.NullString
+		var createdAt sql.NullTime
+		err := rows.Scan(&chatroom.ID, &chatroom.Name, pq.Array(&chatroom.Clients), &chatroom.Category,
+			&chatroom.MemberCount, &chatroom.LastActivityAt, &chatroom.UnreadCount,
+			&id, &senderID, &username, &content, &typ, &seq, &createdAt)
 		if err != nil {
 			return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
 		}
 
+		if id.Valid {
+			chatroom.LastMessage = &domain.ChatMessage{
+				ID:        id.Int64,
+				RoomID:    chatroom.ID,
+				SenderID:  senderID.Int64,
+				Username:  username.String,
+				Content:   content.String,
+				Type:      int(typ.Int64),
+				Seq:       seq.Int64,
+				CreatedAt: createdAt.Time,
+			}
+		}
 		chatrooms = append(chatrooms, &chatroom)
 	}
+	if err := rows.Err(); err != nil {
+		return []*domain.Chatroom{}, domain.ErrInternal.From(err.Error(), err)
+	}
 	return chatrooms, nil
 }
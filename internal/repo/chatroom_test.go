@@ -289,7 +289,7 @@ func TestGetAllChatrooms(t *testing.T) {
 		Password: "password",
 	})
 
-	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, user.ID)
+	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: user.ID, Limit: domain.DefaultRoomLimit})
 	require.NoError(t, err)
 	require.Equal(t, len(chatrooms), 2)
 	for _, chatroom := range chatrooms {
@@ -330,13 +330,120 @@ func TestGetAllChatroomsSomePrivate(t *testing.T) {
 		Password: "password",
 	})
 
-	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, user.ID)
+	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: user.ID, Limit: domain.DefaultRoomLimit})
 	require.NoError(t, err)
 	require.Equal(t, len(chatrooms), 1)
 	require.Equal(t, chatrooms[0].Name, chatroom1.Name)
 	require.Equal(t, chatrooms[0].Category, domain.Public)
 }
 
+func TestGetAllChatroomsUnreadCount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroomMockRepo.DeleteChatroomAll(ctx)
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "chatroom30",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	reader, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "reader1",
+		Email:    "emailReader1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	writer, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "writer1",
+		Email:    "emailWriter1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	_, err = chatroomMockRepo.JoinChatroom(ctx, chatroom.ID, reader.ID)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{RoomID: chatroom.ID, SenderID: writer.ID, Content: "from writer"})
+		require.NoError(t, err)
+	}
+	fromReader, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{RoomID: chatroom.ID, SenderID: reader.ID, Content: "from reader"})
+	require.NoError(t, err)
+
+	// The user's own messages are never unread
+	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: reader.ID, Limit: domain.DefaultRoomLimit})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(chatrooms))
+	require.Equal(t, int64(3), chatrooms[0].UnreadCount)
+	require.Equal(t, "from reader", chatrooms[0].LastMessage.Content)
+	require.Equal(t, "reader1", chatrooms[0].LastMessage.Username)
+	require.Equal(t, int64(4), chatrooms[0].LastMessage.Seq)
+
+	_, err = messageMockRepo.MarkRead(ctx, reader.ID, chatroom.ID, 2)
+	require.NoError(t, err)
+	chatrooms, err = chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: reader.ID, Limit: domain.DefaultRoomLimit})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), chatrooms[0].UnreadCount)
+
+	// Announcements are never unread, and replies and deleted messages are not the last message
+	_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{RoomID: chatroom.ID, SenderID: writer.ID, Content: "writer1 has joined the room", Announcement: true})
+	require.NoError(t, err)
+	_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{RoomID: chatroom.ID, SenderID: reader.ID, Content: "reply", ParentID: fromReader.ID})
+	require.NoError(t, err)
+	deleted, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{RoomID: chatroom.ID, SenderID: reader.ID, Content: "deleted"})
+	require.NoError(t, err)
+	_, err = messageMockRepo.DeleteMessage(ctx, deleted.ID)
+	require.NoError(t, err)
+	chatrooms, err = chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: reader.ID, Limit: domain.DefaultRoomLimit})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), chatrooms[0].UnreadCount)
+	require.Equal(t, "writer1 has joined the room", chatrooms[0].LastMessage.Content)
+
+	// Rooms the user is not a member of have no unread messages
+	chatrooms, err = chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: writer.ID, Limit: domain.DefaultRoomLimit})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), chatrooms[0].UnreadCount)
+	require.NotNil(t, chatrooms[0].LastMessage)
+}
+
+func TestGetContacts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "chatroom31",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	var users []*domain.User
+	for _, name := range []string{"contact1", "contact2", "contact3"} {
+		user, err := userMockRepo.CreateUser(ctx, &domain.User{
+			Username: name,
+			Email:    "email" + name,
+			Password: "password",
+		})
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+
+	_, err = chatroomMockRepo.JoinChatroom(ctx, chatroom.ID, users[0].ID)
+	require.NoError(t, err)
+	_, err = chatroomMockRepo.JoinChatroom(ctx, chatroom.ID, users[1].ID)
+	require.NoError(t, err)
+
+	contacts, err := chatroomMockRepo.GetContacts(ctx, users[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, []int64{users[0].ID, users[1].ID}, contacts)
+
+	// A user without rooms only hears about themselves
+	contacts, err = chatroomMockRepo.GetContacts(ctx, users[2].ID)
+	require.NoError(t, err)
+	require.Equal(t, []int64{users[2].ID}, contacts)
+}
+
 func TestGetAllChatroomsNoChatrooms(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -350,11 +457,87 @@ func TestGetAllChatroomsNoChatrooms(t *testing.T) {
 		Password: "password",
 	})
 
-	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, user.ID)
+	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: user.ID, Limit: domain.DefaultRoomLimit})
 	require.NoError(t, err)
 	require.Equal(t, len(chatrooms), 0)
 }
 
+func TestGetAllChatroomsSearchSortAndPages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroomMockRepo.DeleteChatroomAll(ctx)
+
+	var users []*domain.User
+	for i := 0; i < 3; i++ {
+		user, err := userMockRepo.CreateUser(ctx, &domain.User{
+			Username: fmt.Sprintf("discoverer%d", i),
+			Email:    fmt.Sprintf("emailDiscover%d", i),
+			Password: "password",
+		})
+		require.NoError(t, err)
+		users = append(users, user)
+	}
+
+	// Each room has one member less than the one before, and 100%_rooms has the latest message
+	var rooms []*domain.Chatroom
+	for i, name := range []string{"golf_3", "Alpha Golf", "100%_rooms", "tennis"} {
+		room, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+			Name:     name,
+			Category: domain.Public,
+		})
+		require.NoError(t, err)
+		for _, user := range users[:3-i] {
+			_, err = chatroomMockRepo.JoinChatroom(ctx, room.ID, user.ID)
+			require.NoError(t, err)
+		}
+		rooms = append(rooms, room)
+	}
+	_, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   rooms[2].ID,
+		SenderID: users[0].ID,
+		Content:  "anyone here?",
+	})
+	require.NoError(t, err)
+
+	get := func(req *domain.GetRoomsReq) []string {
+		req.UserID = users[2].ID
+		if req.Limit == 0 {
+			req.Limit = domain.DefaultRoomLimit
+		}
+		chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, req)
+		require.NoError(t, err)
+		names := []string{}
+		for _, chatroom := range chatrooms {
+			names = append(names, chatroom.Name)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"Alpha Golf", "golf_3"}, get(&domain.GetRoomsReq{Search: "GOLF"}))
+	require.Equal(t, []string{"golf_3"}, get(&domain.GetRoomsReq{Search: "_3"}))
+	require.Equal(t, []string{"100%_rooms"}, get(&domain.GetRoomsReq{Search: "%_"}))
+
+	joined := true
+	require.Equal(t, []string{"golf_3"}, get(&domain.GetRoomsReq{Joined: &joined}))
+	joined = false
+	require.Equal(t, []string{"100%_rooms", "Alpha Golf", "tennis"}, get(&domain.GetRoomsReq{Joined: &joined}))
+
+	require.Equal(t, []string{"golf_3", "Alpha Golf", "100%_rooms", "tennis"}, get(&domain.GetRoomsReq{Sort: domain.RoomSortMembers}))
+	require.Equal(t, "100%_rooms", get(&domain.GetRoomsReq{Sort: domain.RoomSortActivity})[0])
+
+	// Pages continue after the cursor of the last room
+	chatrooms, err := chatroomMockRepo.GetAllChatrooms(ctx, &domain.GetRoomsReq{UserID: users[0].ID, Sort: domain.RoomSortMembers, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(chatrooms))
+	require.Equal(t, 3, chatrooms[0].MemberCount)
+	after := domain.NewRoomCursor(domain.RoomSortMembers, chatrooms[1])
+	require.Equal(t, []string{"100%_rooms", "tennis"}, get(&domain.GetRoomsReq{Sort: domain.RoomSortMembers, After: after}))
+
+	after = domain.NewRoomCursor(domain.RoomSortName, rooms[1])
+	require.Equal(t, []string{"golf_3", "tennis"}, get(&domain.GetRoomsReq{After: after}))
+}
+
 func TestLeaveChatroom(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -0,0 +1,535 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"server/internal/domain"
+	"server/internal/port"
+
+	"github.com/lib/pq"
+)
+
+// messageColumns are the columns scanned by scanMessage, from chat_messages joined with users.
+const messageColumns = "chat_messages.id, chat_messages.room_id, chat_messages.sender_id, users.username, chat_messages.content, " +
+	"chat_messages.type, chat_messages.seq, chat_messages.created_at, chat_messages.edited_at, chat_messages.deleted_at, " +
+	"chat_messages.parent_id, chat_messages.reply_count, chat_messages.last_reply_at, " +
+	"array(SELECT user_id FROM message_mentions WHERE message_id = chat_messages.id ORDER BY user_id)"
+
+type messageRepository struct {
+	db DBTX
+}
+
+func NewMessageRepository(db DBTX) port.MessageRepoPort {
+	return &messageRepository{db: db}
+}
+
+// CreateMessage stores the message under the room's next sequence number. A reply
+// also counts towards its parent, which must be a message of the same room that
+// is neither a reply nor deleted. The users mentioned in the content are recorded
+// if they may read the room; senders do not mention themselves.
+func (r *messageRepository) CreateMessage(ctx context.Context, message *domain.ChatMessage) (*domain.ChatMessage, error) {
+	query := `
+		WITH parent AS (
+			UPDATE chat_messages SET reply_count = reply_count + 1, last_reply_at = now()
+			WHERE id = $5 AND room_id = $1 AND parent_id IS NULL AND deleted_at IS NULL
+			RETURNING id
+		), next AS (
+			UPDATE chatrooms SET last_seq = last_seq + 1, last_activity_at = now()
+			WHERE id = $1 AND ($5::bigint IS NULL OR EXISTS (SELECT 1 FROM parent))
+			RETURNING last_seq
+		), inserted AS (
+			INSERT INTO chat_messages (room_id, sender_id, content, type, seq, parent_id, announcement)
+			SELECT $1, $2, $3, $4, last_seq, $5, $7 FROM next
+			RETURNING id, seq, created_at
+		), mentioned AS (
+			INSERT INTO message_mentions (message_id, user_id)
+			SELECT inserted.id, users.id FROM inserted, users, chatrooms
+			WHERE users.username = ANY($6) AND users.id <> $2 AND chatrooms.id = $1
+				AND (chatrooms.category = 'public' OR users.id = ANY(chatrooms.clients))
+			RETURNING user_id
+		)
+		SELECT id, seq, created_at, array(SELECT user_id FROM mentioned ORDER BY user_id) FROM inserted
+	`
+	parentID := sql.NullInt64{Int64: message.ParentID, Valid: message.ParentID != 0}
+	mentions := pq.Array(domain.ParseMentions(message.Content))
+	err := r.db.QueryRowContext(ctx, query, message.RoomID, message.SenderID, message.Content, message.Type, parentID, mentions, message.Announcement).
+		Scan(&message.ID, &message.Seq, &message.CreatedAt, pq.Array(&message.Mentions))
+	if err == sql.ErrNoRows && message.ParentID != 0 {
+		return &domain.ChatMessage{}, domain.ErrMessageIDNotFound.With("message with id %d cannot be replied to in chatroom with id %d", message.ParentID, message.RoomID)
+	}
+	if err == sql.ErrNoRows {
+		return &domain.ChatMessage{}, domain.ErrChatroomIDNotFound.With("chatroom with id %d does not exist", message.RoomID)
+	}
+	if err != nil {
+		return &domain.ChatMessage{}, domain.ErrInternal.From(err.Error(), err)
+	}
+
+	return message, nil
+}
+
+func (r *messageRepository) GetMessageByID(ctx context.Context, id int64) (*domain.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages JOIN users ON users.id = chat_messages.sender_id
+		WHERE chat_messages.id = $1
+	`
+	m, err := scanMessage(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return &domain.ChatMessage{}, domain.ErrMessageIDNotFound.With("message with id %d does not exist", id)
+	}
+	if err != nil {
+		return &domain.ChatMessage{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return m, nil
+}
+
+// GetMessagesByRoom returns up to limit messages older than before (or the latest
+// messages when before is 0), oldest first. Replies are left to GetReplies.
+func (r *messageRepository) GetMessagesByRoom(ctx context.Context, roomID int64, before int64, limit int) ([]*domain.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages JOIN users ON users.id = chat_messages.sender_id
+		WHERE room_id = $1 AND parent_id IS NULL AND ($2 = 0 OR chat_messages.id < $2)
+		ORDER BY chat_messages.id DESC
+		LIMIT $3
+	`
+	return r.queryPage(ctx, query, roomID, before, limit)
+}
+
+// GetReplies returns up to limit replies to the message older than before (or the
+// latest replies when before is 0), oldest first.
+func (r *messageRepository) GetReplies(ctx context.Context, parentID int64, before int64, limit int) ([]*domain.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages JOIN users ON users.id = chat_messages.sender_id
+		WHERE parent_id = $1 AND ($2 = 0 OR chat_messages.id < $2)
+		ORDER BY chat_messages.id DESC
+		LIMIT $3
+	`
+	return r.queryPage(ctx, query, parentID, before, limit)
+}
+
+// GetMentions returns up to limit messages mentioning the user older than before
+// (or the latest ones when before is 0), newest first. Deleted messages and those
+// of private rooms the user is no longer in are left out.
+func (r *messageRepository) GetMentions(ctx context.Context, userID int64, before int64, limit int) ([]*domain.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM message_mentions
+		JOIN chat_messages ON chat_messages.id = message_mentions.message_id
+		JOIN users ON users.id = chat_messages.sender_id
+		JOIN chatrooms ON chatrooms.id = chat_messages.room_id
+		WHERE message_mentions.user_id = $1 AND chat_messages.deleted_at IS NULL
+			AND (chatrooms.category = 'public' OR $1 = ANY(chatrooms.clients))
+			AND ($2 = 0 OR chat_messages.id < $2)
+		ORDER BY chat_messages.id DESC
+		LIMIT $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID, before, limit)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+// queryPage runs a query selecting messages newest first and returns them oldest first.
+func (r *messageRepository) queryPage(ctx context.Context, query string, id int64, before int64, limit int) ([]*domain.ChatMessage, error) {
+	rows, err := r.db.QueryContext(ctx, query, id, before, limit)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// GetMessagesSince returns up to limit messages with a sequence number greater than since, oldest first.
+func (r *messageRepository) GetMessagesSince(ctx context.Context, roomID int64, since int64, limit int) ([]*domain.ChatMessage, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM chat_messages JOIN users ON users.id = chat_messages.sender_id
+		WHERE room_id = $1 AND seq > $2
+		ORDER BY seq
+		LIMIT $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, roomID, since, limit)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (*domain.ChatMessage, error) {
+	var m domain.ChatMessage
+	var parentID sql.NullInt64
+	err := row.Scan(&m.ID, &m.RoomID, &m.SenderID, &m.Username, &m.Content, &m.Type, &m.Seq, &m.CreatedAt, &m.EditedAt, &m.DeletedAt,
+		&parentID, &m.ReplyCount, &m.LastReplyAt, pq.Array(&m.Mentions))
+	if err != nil {
+		return nil, err
+	}
+	m.ParentID = parentID.Int64
+	return &m, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]*domain.ChatMessage, error) {
+	messages := []*domain.ChatMessage{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return messages, nil
+}
+
+// MarkRead moves the user's read marker for the room forward to seq, capped at the
+// room's latest message. A marker never moves backwards.
+func (r *messageRepository) MarkRead(ctx context.Context, userID int64, roomID int64, seq int64) (*domain.ReadReceipt, error) {
+	query := `
+		INSERT INTO room_reads (user_id, room_id, last_read_seq)
+		SELECT $1::bigint, id, LEAST($3::bigint, last_seq) FROM chatrooms WHERE id = $2
+		ON CONFLICT (user_id, room_id) DO UPDATE
+		SET last_read_seq = GREATEST(room_reads.last_read_seq, EXCLUDED.last_read_seq), updated_at = now()
+		RETURNING last_read_seq, updated_at
+	`
+	receipt := domain.ReadReceipt{RoomID: roomID, UserID: userID}
+	err := r.db.QueryRowContext(ctx, query, userID, roomID, seq).Scan(&receipt.LastReadSeq, &receipt.ReadAt)
+	if err == sql.ErrNoRows {
+		return &domain.ReadReceipt{}, domain.ErrChatroomIDNotFound.With("chatroom with id %d does not exist", roomID)
+	}
+	if err != nil {
+		return &domain.ReadReceipt{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return &receipt, nil
+}
+
+// EditMessage replaces the content of a message that was not deleted, recording
+// the previous content as an edit by editorID.
+func (r *messageRepository) EditMessage(ctx context.Context, id int64, editorID int64, content string) (*domain.ChatMessage, error) {
+	query := `
+		WITH previous AS (
+			SELECT id AS message_id, content AS previous_content FROM chat_messages
+			WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+		), history AS (
+			INSERT INTO message_edits (message_id, editor_id, content) SELECT message_id, $2, previous_content FROM previous
+		)
+		UPDATE chat_messages SET content = $3, edited_at = now()
+		FROM previous, users
+		WHERE chat_messages.id = previous.message_id AND users.id = chat_messages.sender_id
+		RETURNING ` + messageColumns + `
+	`
+	m, err := scanMessage(r.db.QueryRowContext(ctx, query, id, editorID, content))
+	if err == sql.ErrNoRows {
+		return &domain.ChatMessage{}, domain.ErrMessageIDNotFound.With("message with id %d does not exist or was deleted", id)
+	}
+	if err != nil {
+		return &domain.ChatMessage{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return m, nil
+}
+
+// DeleteMessage turns a message into a tombstone: it keeps its place in the room
+// but loses its content, edit history and reactions, and is unpinned. Deleting a
+// reply also takes it out of its parent's reply count.
+func (r *messageRepository) DeleteMessage(ctx context.Context, id int64) (*domain.ChatMessage, error) {
+	query := `
+		WITH history AS (
+			DELETE FROM message_edits WHERE message_id = $1
+		), reactions AS (
+			DELETE FROM message_reactions WHERE message_id = $1
+		), pins AS (
+			DELETE FROM room_pins WHERE message_id = $1
+		), parent AS (
+			UPDATE chat_messages thread SET reply_count = thread.reply_count - 1, last_reply_at = (
+				SELECT max(created_at) FROM chat_messages
+				WHERE parent_id = thread.id AND id <> $1 AND deleted_at IS NULL
+			)
+			FROM chat_messages reply
+			WHERE reply.id = $1 AND reply.deleted_at IS NULL AND thread.id = reply.parent_id
+		)
+		UPDATE chat_messages SET content = '', deleted_at = now()
+		FROM users
+		WHERE chat_messages.id = $1 AND chat_messages.deleted_at IS NULL AND users.id = chat_messages.sender_id
+		RETURNING ` + messageColumns + `
+	`
+	m, err := scanMessage(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return &domain.ChatMessage{}, domain.ErrMessageIDNotFound.With("message with id %d does not exist or was deleted", id)
+	}
+	if err != nil {
+		return &domain.ChatMessage{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return m, nil
+}
+
+// GetMessageEdits returns the earlier versions of a message, oldest first.
+func (r *messageRepository) GetMessageEdits(ctx context.Context, id int64) ([]*domain.MessageEdit, error) {
+	query := `
+		SELECT message_id, editor_id, content, edited_at FROM message_edits
+		WHERE message_id = $1
+		ORDER BY id
+	`
+	rows, err := r.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	edits := []*domain.MessageEdit{}
+	for rows.Next() {
+		var e domain.MessageEdit
+		if err := rows.Scan(&e.MessageID, &e.EditorID, &e.Content, &e.EditedAt); err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		edits = append(edits, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return edits, nil
+}
+
+// AddReaction adds the user's emoji reaction to a message that was not deleted.
+// Adding a reaction that is already there changes nothing.
+func (r *messageRepository) AddReaction(ctx context.Context, messageID int64, userID int64, emoji string) (*domain.Reaction, error) {
+	// The count does not see the row inserted by the same statement, hence the sum
+	query := `
+		WITH message AS (
+			SELECT id, room_id, parent_id FROM chat_messages WHERE id = $1 AND deleted_at IS NULL
+		), changed AS (
+			INSERT INTO message_reactions (message_id, user_id, emoji) SELECT id, $2, $3 FROM message
+			ON CONFLICT DO NOTHING
+			RETURNING message_id
+		)
+		SELECT message.room_id, message.parent_id, EXISTS (SELECT 1 FROM changed),
+			(SELECT count(*) FROM message_reactions WHERE message_id = $1 AND emoji = $3) + (SELECT count(*) FROM changed)
+		FROM message
+	`
+	return r.react(ctx, query, messageID, userID, emoji, false)
+}
+
+// RemoveReaction takes the user's emoji reaction off a message that was not deleted.
+// Removing a reaction that is not there changes nothing.
+func (r *messageRepository) RemoveReaction(ctx context.Context, messageID int64, userID int64, emoji string) (*domain.Reaction, error) {
+	query := `
+		WITH message AS (
+			SELECT id, room_id, parent_id FROM chat_messages WHERE id = $1 AND deleted_at IS NULL
+		), changed AS (
+			DELETE FROM message_reactions WHERE message_id IN (SELECT id FROM message) AND user_id = $2 AND emoji = $3
+			RETURNING message_id
+		)
+		SELECT message.room_id, message.parent_id, EXISTS (SELECT 1 FROM changed),
+			(SELECT count(*) FROM message_reactions WHERE message_id = $1 AND emoji = $3) - (SELECT count(*) FROM changed)
+		FROM message
+	`
+	return r.react(ctx, query, messageID, userID, emoji, true)
+}
+
+func (r *messageRepository) react(ctx context.Context, query string, messageID int64, userID int64, emoji string, remove bool) (*domain.Reaction, error) {
+	reaction := &domain.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji, Removed: remove}
+	var parentID sql.NullInt64
+	err := r.db.QueryRowContext(ctx, query, messageID, userID, emoji).Scan(&reaction.RoomID, &parentID, &reaction.Changed, &reaction.Count)
+	reaction.ParentID = parentID.Int64
+	if err == sql.ErrNoRows {
+		return &domain.Reaction{}, domain.ErrMessageIDNotFound.With("message with id %d does not exist or was deleted", messageID)
+	}
+	if err != nil {
+		return &domain.Reaction{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return reaction, nil
+}
+
+// GetReactions sums up the reactions to each of the messages, keyed by message ID.
+// Emoji are ordered by their first reaction.
+func (r *messageRepository) GetReactions(ctx context.Context, messageIDs []int64) (map[int64][]*domain.ReactionCount, error) {
+	query := `
+		SELECT message_id, emoji, count(*), array_agg(user_id ORDER BY created_at, user_id)
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, min(created_at), emoji
+	`
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(messageIDs))
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	reactions := make(map[int64][]*domain.ReactionCount)
+	for rows.Next() {
+		var messageID int64
+		var rc domain.ReactionCount
+		if err := rows.Scan(&messageID, &rc.Emoji, &rc.Count, pq.Array(&rc.UserIDs)); err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		reactions[messageID] = append(reactions[messageID], &rc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return reactions, nil
+}
+
+// PinMessage pins a message that was not deleted to its room, unless the room
+// already has domain.MaxPins pins. Pinning a pinned message changes nothing.
+func (r *messageRepository) PinMessage(ctx context.Context, roomID int64, messageID int64, userID int64) (*domain.Pin, error) {
+	query := `
+		INSERT INTO room_pins (room_id, message_id, pinned_by)
+		SELECT room_id, id, $3 FROM chat_messages
+		WHERE id = $2 AND room_id = $1 AND deleted_at IS NULL
+			AND (SELECT count(*) FROM room_pins WHERE room_id = $1) < $4
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := r.db.ExecContext(ctx, query, roomID, messageID, userID, domain.MaxPins); err != nil {
+		return &domain.Pin{}, domain.ErrInternal.From(err.Error(), err)
+	}
+
+	pins, err := queryPins(ctx, r.db, "WHERE room_pins.room_id = $1 AND room_pins.message_id = $2", roomID, messageID)
+	if err != nil {
+		return &domain.Pin{}, err
+	}
+	if len(pins) != 0 {
+		return pins[0], nil
+	}
+
+	// Nothing was pinned: find out why
+	m, err := r.GetMessageByID(ctx, messageID)
+	if err != nil || m.RoomID != roomID || m.DeletedAt != nil {
+		return &domain.Pin{}, domain.ErrMessageIDNotFound.With("message with id %d does not exist in chatroom with id %d or was deleted", messageID, roomID)
+	}
+	return &domain.Pin{}, domain.ErrTooManyPins.With("chatroom with id %d already has %d pinned messages", roomID, domain.MaxPins)
+}
+
+// UnpinMessage removes a pin and returns it, without its message.
+func (r *messageRepository) UnpinMessage(ctx context.Context, roomID int64, messageID int64) (*domain.Pin, error) {
+	query := "DELETE FROM room_pins WHERE room_id = $1 AND message_id = $2 RETURNING pinned_by, pinned_at"
+	pin := &domain.Pin{RoomID: roomID, MessageID: messageID}
+	err := r.db.QueryRowContext(ctx, query, roomID, messageID).Scan(&pin.PinnedBy, &pin.PinnedAt)
+	if err == sql.ErrNoRows {
+		return &domain.Pin{}, domain.ErrMessageIDNotFound.With("message with id %d is not pinned in chatroom with id %d", messageID, roomID)
+	}
+	if err != nil {
+		return &domain.Pin{}, domain.ErrInternal.From(err.Error(), err)
+	}
+	return pin, nil
+}
+
+// GetPins returns the pins of the room, most recently pinned first.
+func (r *messageRepository) GetPins(ctx context.Context, roomID int64) ([]*domain.Pin, error) {
+	return queryPins(ctx, r.db, "WHERE room_pins.room_id = $1", roomID)
+}
+
+// queryPins selects pins along with their messages. Shared with the chatroom repository.
+func queryPins(ctx context.Context, db DBTX, where string, args ...any) ([]*domain.Pin, error) {
+	query := `
+		SELECT room_pins.room_id, room_pins.message_id, room_pins.pinned_by, room_pins.pinned_at, ` + messageColumns + `
+		FROM room_pins
+		JOIN chat_messages ON chat_messages.id = room_pins.message_id
+		JOIN users ON users.id = chat_messages.sender_id
+		` + where + `
+		ORDER BY room_pins.pinned_at DESC, room_pins.message_id DESC
+	`
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	pins := []*domain.Pin{}
+	for rows.Next() {
+		var pin domain.Pin
+		m, err := scanMessage(&extraColumns{row: rows, before: []any{&pin.RoomID, &pin.MessageID, &pin.PinnedBy, &pin.PinnedAt}})
+		if err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		pin.Message = m
+		pins = append(pins, &pin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return pins, nil
+}
+
+// extraColumns scans columns selected before and after the message columns read by scanMessage.
+type extraColumns struct {
+	row    rowScanner
+	before []any
+	after  []any
+}
+
+func (s *extraColumns) Scan(dest ...any) error {
+	all := append(append(append([]any{}, s.before...), dest...), s.after...)
+	return s.row.Scan(all...)
+}
+
+// SearchMessages returns messages of the rooms the user is a member of that match
+// the search, newest first, each with a highlighted snippet. The query is read
+// like a web search: quoted phrases, OR and -word are understood.
+func (r *messageRepository) SearchMessages(ctx context.Context, req *domain.SearchMessagesReq) ([]*domain.SearchResult, error) {
+	// The content is escaped before highlighting, so snippets are safe to show as HTML
+	query := `
+		SELECT ` + messageColumns + `,
+			ts_headline('english', replace(replace(replace(chat_messages.content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), query,
+				'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5')
+		FROM chat_messages
+		JOIN users ON users.id = chat_messages.sender_id
+		JOIN chatrooms ON chatrooms.id = chat_messages.room_id,
+		websearch_to_tsquery('english', $2) AS query
+		WHERE chat_messages.search @@ query AND chatrooms.clients @> ARRAY[$1::bigint] AND chat_messages.deleted_at IS NULL
+			AND ($3 = 0 OR chat_messages.room_id = $3)
+			AND ($4 = 0 OR chat_messages.sender_id = $4)
+			AND ($5 = 0 OR chat_messages.id < $5)
+		ORDER BY chat_messages.id DESC
+		LIMIT $6
+	`
+	rows, err := r.db.QueryContext(ctx, query, req.UserID, req.Query, req.RoomID, req.FromID, req.Before, req.Limit)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	results := []*domain.SearchResult{}
+	for rows.Next() {
+		var result domain.SearchResult
+		m, err := scanMessage(&extraColumns{row: rows, after: []any{&result.Snippet}})
+		if err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		result.Message = m
+		results = append(results, &result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return results, nil
+}
+
+func (r *messageRepository) DeleteMessageAll(ctx context.Context) error { // Testing purposes
+	query := "DELETE FROM chat_messages WHERE id > 0"
+	_, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	return nil
+}
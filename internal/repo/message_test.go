@@ -0,0 +1,719 @@
+package repo_test
+
+import (
+	"context"
+	"fmt"
+	"server/internal/domain"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom1",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager1",
+		Email:    "emailMessage1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	message, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user.ID,
+		Username: user.Username,
+		Content:  "hello",
+	})
+	require.NoError(t, err)
+	require.NotZero(t, message.ID)
+	require.Equal(t, int64(1), message.Seq)
+	require.False(t, message.CreatedAt.IsZero())
+
+	messages, err := messageMockRepo.GetMessagesByRoom(ctx, chatroom.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, messages[0].ID, message.ID)
+	require.Equal(t, messages[0].Content, "hello")
+	require.Equal(t, messages[0].Username, "messager1")
+
+	byID, err := messageMockRepo.GetMessageByID(ctx, message.ID)
+	require.NoError(t, err)
+	require.Equal(t, byID.Content, "hello")
+	require.Equal(t, byID.Seq, message.Seq)
+}
+
+func TestGetMessageByIDInvalidID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := messageMockRepo.GetMessageByID(ctx, 0)
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestCreateMessageInvalidRoomID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager2",
+		Email:    "emailMessage2",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   0,
+		SenderID: user.ID,
+		Content:  "hello",
+	})
+	require.ErrorIs(t, err, domain.ErrChatroomIDNotFound)
+}
+
+func TestGetMessagesByRoomPagination(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom3",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager3",
+		Email:    "emailMessage3",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   chatroom.ID,
+			SenderID: user.ID,
+			Content:  fmt.Sprintf("message %d", i),
+		})
+		require.NoError(t, err)
+	}
+
+	latest, err := messageMockRepo.GetMessagesByRoom(ctx, chatroom.ID, 0, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(latest))
+	require.Equal(t, latest[0].Content, "message 2")
+	require.Equal(t, latest[2].Content, "message 4")
+
+	older, err := messageMockRepo.GetMessagesByRoom(ctx, chatroom.ID, latest[0].ID, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(older))
+	require.Equal(t, older[0].Content, "message 0")
+	require.Equal(t, older[1].Content, "message 1")
+}
+
+func TestGetMessagesByRoomNoMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom4",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	messages, err := messageMockRepo.GetMessagesByRoom(ctx, chatroom.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(messages))
+}
+
+func TestGetMessagesSince(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom1, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom5",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+	chatroom2, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom6",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager5",
+		Email:    "emailMessage5",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		m, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   chatroom1.ID,
+			SenderID: user.ID,
+			Content:  fmt.Sprintf("message %d", i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), m.Seq)
+	}
+	// Sequence numbers are per room
+	m, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom2.ID,
+		SenderID: user.ID,
+		Content:  "other room",
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), m.Seq)
+
+	messages, err := messageMockRepo.GetMessagesSince(ctx, chatroom1.ID, 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, int64(3), messages[0].Seq)
+	require.Equal(t, "message 2", messages[0].Content)
+	require.Equal(t, int64(4), messages[1].Seq)
+
+	messages, err = messageMockRepo.GetMessagesSince(ctx, chatroom1.ID, 4, 10)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(messages))
+}
+
+func TestMarkRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom7",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager7",
+		Email:    "emailMessage7",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   chatroom.ID,
+			SenderID: user.ID,
+			Content:  fmt.Sprintf("message %d", i),
+		})
+		require.NoError(t, err)
+	}
+
+	receipt, err := messageMockRepo.MarkRead(ctx, user.ID, chatroom.ID, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), receipt.LastReadSeq)
+	require.False(t, receipt.ReadAt.IsZero())
+
+	// The marker never moves backwards
+	receipt, err = messageMockRepo.MarkRead(ctx, user.ID, chatroom.ID, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), receipt.LastReadSeq)
+
+	// and never past the latest message
+	receipt, err = messageMockRepo.MarkRead(ctx, user.ID, chatroom.ID, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), receipt.LastReadSeq)
+}
+
+func TestMarkReadInvalidRoomID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager8",
+		Email:    "emailMessage8",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	_, err = messageMockRepo.MarkRead(ctx, user.ID, -1, 1)
+	require.ErrorIs(t, err, domain.ErrChatroomIDNotFound)
+}
+
+func TestEditMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom9",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager9",
+		Email:    "emailMessage9",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	message, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user.ID,
+		Content:  "first",
+	})
+	require.NoError(t, err)
+
+	edited, err := messageMockRepo.EditMessage(ctx, message.ID, user.ID, "second")
+	require.NoError(t, err)
+	require.Equal(t, "second", edited.Content)
+	require.Equal(t, message.Seq, edited.Seq)
+	require.NotNil(t, edited.EditedAt)
+
+	_, err = messageMockRepo.EditMessage(ctx, message.ID, user.ID, "third")
+	require.NoError(t, err)
+
+	edits, err := messageMockRepo.GetMessageEdits(ctx, message.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(edits))
+	require.Equal(t, "first", edits[0].Content)
+	require.Equal(t, "second", edits[1].Content)
+	require.Equal(t, user.ID, edits[0].EditorID)
+
+	_, err = messageMockRepo.EditMessage(ctx, -1, user.ID, "nothing")
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestDeleteMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom10",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager10",
+		Email:    "emailMessage10",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	message, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user.ID,
+		Content:  "secret",
+	})
+	require.NoError(t, err)
+	_, err = messageMockRepo.EditMessage(ctx, message.ID, user.ID, "still secret")
+	require.NoError(t, err)
+
+	deleted, err := messageMockRepo.DeleteMessage(ctx, message.ID)
+	require.NoError(t, err)
+	require.Empty(t, deleted.Content)
+	require.NotNil(t, deleted.DeletedAt)
+
+	// The tombstone keeps its place in the room, without the history
+	messages, err := messageMockRepo.GetMessagesSince(ctx, chatroom.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.NotNil(t, messages[0].DeletedAt)
+	edits, err := messageMockRepo.GetMessageEdits(ctx, message.ID)
+	require.NoError(t, err)
+	require.Empty(t, edits)
+
+	// A tombstone can be neither edited nor deleted again
+	_, err = messageMockRepo.EditMessage(ctx, message.ID, user.ID, "back")
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+	_, err = messageMockRepo.DeleteMessage(ctx, message.ID)
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestReactions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom11",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user1, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager11",
+		Email:    "emailMessage11",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	user2, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager12",
+		Email:    "emailMessage12",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	message, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user1.ID,
+		Content:  "react to me",
+	})
+	require.NoError(t, err)
+
+	reaction, err := messageMockRepo.AddReaction(ctx, message.ID, user1.ID, "👍")
+	require.NoError(t, err)
+	require.True(t, reaction.Changed)
+	require.Equal(t, 1, reaction.Count)
+	require.Equal(t, chatroom.ID, reaction.RoomID)
+
+	// Adding the same reaction again changes nothing
+	reaction, err = messageMockRepo.AddReaction(ctx, message.ID, user1.ID, "👍")
+	require.NoError(t, err)
+	require.False(t, reaction.Changed)
+	require.Equal(t, 1, reaction.Count)
+
+	reaction, err = messageMockRepo.AddReaction(ctx, message.ID, user2.ID, "👍")
+	require.NoError(t, err)
+	require.Equal(t, 2, reaction.Count)
+	_, err = messageMockRepo.AddReaction(ctx, message.ID, user2.ID, "🎉")
+	require.NoError(t, err)
+
+	reactions, err := messageMockRepo.GetReactions(ctx, []int64{message.ID})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(reactions[message.ID]))
+	require.Equal(t, "👍", reactions[message.ID][0].Emoji)
+	require.Equal(t, 2, reactions[message.ID][0].Count)
+	require.Equal(t, []int64{user1.ID, user2.ID}, reactions[message.ID][0].UserIDs)
+
+	reaction, err = messageMockRepo.RemoveReaction(ctx, message.ID, user1.ID, "👍")
+	require.NoError(t, err)
+	require.True(t, reaction.Changed)
+	require.Equal(t, 1, reaction.Count)
+
+	// and so does removing it again
+	reaction, err = messageMockRepo.RemoveReaction(ctx, message.ID, user1.ID, "👍")
+	require.NoError(t, err)
+	require.False(t, reaction.Changed)
+	require.Equal(t, 1, reaction.Count)
+
+	// Deleting the message drops its reactions
+	_, err = messageMockRepo.DeleteMessage(ctx, message.ID)
+	require.NoError(t, err)
+	reactions, err = messageMockRepo.GetReactions(ctx, []int64{message.ID})
+	require.NoError(t, err)
+	require.Empty(t, reactions)
+	_, err = messageMockRepo.AddReaction(ctx, message.ID, user1.ID, "👍")
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestReplies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom12",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+	other, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "messageRoom13",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "messager13",
+		Email:    "emailMessage13",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	parent, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user.ID,
+		Content:  "parent",
+	})
+	require.NoError(t, err)
+
+	var replies []*domain.ChatMessage
+	for i := 0; i < 3; i++ {
+		reply, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   chatroom.ID,
+			SenderID: user.ID,
+			Content:  fmt.Sprintf("reply %d", i),
+			ParentID: parent.ID,
+		})
+		require.NoError(t, err)
+		replies = append(replies, reply)
+	}
+
+	// Replies take up sequence numbers of the room like any other message
+	require.Equal(t, parent.Seq+3, replies[2].Seq)
+
+	parent, err = messageMockRepo.GetMessageByID(ctx, parent.ID)
+	require.NoError(t, err)
+	require.Equal(t, 3, parent.ReplyCount)
+	require.NotNil(t, parent.LastReplyAt)
+
+	// The room's timeline leaves out the replies
+	messages, err := messageMockRepo.GetMessagesByRoom(ctx, chatroom.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, parent.ID, messages[0].ID)
+
+	page, err := messageMockRepo.GetReplies(ctx, parent.ID, 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page))
+	require.Equal(t, "reply 1", page[0].Content)
+	require.Equal(t, parent.ID, page[0].ParentID)
+	page, err = messageMockRepo.GetReplies(ctx, parent.ID, page[0].ID, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page))
+	require.Equal(t, "reply 0", page[0].Content)
+
+	// Deleting a reply takes it out of the parent's count, once
+	_, err = messageMockRepo.DeleteMessage(ctx, replies[2].ID)
+	require.NoError(t, err)
+	_, err = messageMockRepo.DeleteMessage(ctx, replies[2].ID)
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+	parent, err = messageMockRepo.GetMessageByID(ctx, parent.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, parent.ReplyCount)
+	require.Equal(t, replies[1].CreatedAt.Unix(), parent.LastReplyAt.Unix())
+
+	// Replies cannot be replied to, nor can messages of other rooms
+	_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   chatroom.ID,
+		SenderID: user.ID,
+		Content:  "nested",
+		ParentID: replies[0].ID,
+	})
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+	_, err = messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   other.ID,
+		SenderID: user.ID,
+		Content:  "elsewhere",
+		ParentID: parent.ID,
+	})
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestMentions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sender, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "mentioner",
+		Email:    "emailMention1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	member, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "mentioned.member",
+		Email:    "emailMention2",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	outsider, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "mentioned-outsider",
+		Email:    "emailMention3",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	public, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "mentionRoom1",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+	private, err := chatroomMockRepo.CreateDM(ctx, &domain.CreateDMReq{
+		RoomName:  "mentionRoom2",
+		MyID:      sender.ID,
+		PartnerID: member.ID,
+	})
+	require.NoError(t, err)
+
+	// Anyone can be mentioned in a public room, but senders do not mention themselves
+	message, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   public.ID,
+		SenderID: sender.ID,
+		Content:  "@mentioner @mentioned.member, @mentioned-outsider. @nobody",
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int64{member.ID, outsider.ID}, message.Mentions)
+
+	// Only members can be mentioned in a private room
+	dm, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+		RoomID:   private.ID,
+		SenderID: sender.ID,
+		Content:  "@mentioned.member @mentioned-outsider",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{member.ID}, dm.Mentions)
+
+	stored, err := messageMockRepo.GetMessageByID(ctx, dm.ID)
+	require.NoError(t, err)
+	require.Equal(t, []int64{member.ID}, stored.Mentions)
+
+	mentions, err := messageMockRepo.GetMentions(ctx, member.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mentions))
+	require.Equal(t, dm.ID, mentions[0].ID)
+	require.Equal(t, message.ID, mentions[1].ID)
+
+	mentions, err = messageMockRepo.GetMentions(ctx, outsider.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mentions))
+
+	// Deleted messages leave the inbox
+	_, err = messageMockRepo.DeleteMessage(ctx, message.ID)
+	require.NoError(t, err)
+	mentions, err = messageMockRepo.GetMentions(ctx, outsider.ID, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, mentions)
+}
+
+func TestPins(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "pinner",
+		Email:    "emailPin1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	chatroom, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:       "pinRoom1",
+		Category:   domain.Public,
+		Moderators: []int64{user.ID},
+	})
+	require.NoError(t, err)
+
+	var messages []*domain.ChatMessage
+	for i := 0; i <= domain.MaxPins; i++ {
+		m, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   chatroom.ID,
+			SenderID: user.ID,
+			Content:  fmt.Sprintf("pin me %d", i),
+		})
+		require.NoError(t, err)
+		messages = append(messages, m)
+	}
+
+	pin, err := messageMockRepo.PinMessage(ctx, chatroom.ID, messages[0].ID, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, pin.PinnedBy)
+	require.Equal(t, "pin me 0", pin.Message.Content)
+
+	// Pinning again changes nothing
+	again, err := messageMockRepo.PinMessage(ctx, chatroom.ID, messages[0].ID, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, pin.PinnedAt, again.PinnedAt)
+
+	room, err := chatroomMockRepo.GetChatroomByID(ctx, chatroom.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(room.Pins))
+	require.Equal(t, messages[0].ID, room.Pins[0].MessageID)
+
+	// Rooms have a limited number of pins
+	for _, m := range messages[1:domain.MaxPins] {
+		_, err := messageMockRepo.PinMessage(ctx, chatroom.ID, m.ID, user.ID)
+		require.NoError(t, err)
+	}
+	_, err = messageMockRepo.PinMessage(ctx, chatroom.ID, messages[domain.MaxPins].ID, user.ID)
+	require.ErrorIs(t, err, domain.ErrTooManyPins)
+
+	unpinned, err := messageMockRepo.UnpinMessage(ctx, chatroom.ID, messages[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, unpinned.PinnedBy)
+	_, err = messageMockRepo.UnpinMessage(ctx, chatroom.ID, messages[0].ID)
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+
+	// Deleting a message unpins it
+	_, err = messageMockRepo.DeleteMessage(ctx, messages[1].ID)
+	require.NoError(t, err)
+	pins, err := messageMockRepo.GetPins(ctx, chatroom.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.MaxPins-2, len(pins))
+
+	_, err = messageMockRepo.PinMessage(ctx, chatroom.ID, -1, user.ID)
+	require.ErrorIs(t, err, domain.ErrMessageIDNotFound)
+}
+
+func TestSearchMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "searcher",
+		Email:    "emailSearch1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	other, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "searched",
+		Email:    "emailSearch2",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	joined, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "searchRoom1",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+	_, err = chatroomMockRepo.JoinChatroom(ctx, joined.ID, user.ID)
+	require.NoError(t, err)
+	notJoined, err := chatroomMockRepo.CreateChatroom(ctx, &domain.Chatroom{
+		Name:     "searchRoom2",
+		Category: domain.Public,
+	})
+	require.NoError(t, err)
+	dm, err := chatroomMockRepo.CreateDM(ctx, &domain.CreateDMReq{
+		RoomName:  "searchRoom3",
+		MyID:      user.ID,
+		PartnerID: other.ID,
+	})
+	require.NoError(t, err)
+
+	send := func(roomID, senderID int64, content string) *domain.ChatMessage {
+		m, err := messageMockRepo.CreateMessage(ctx, &domain.ChatMessage{
+			RoomID:   roomID,
+			SenderID: senderID,
+			Content:  content,
+		})
+		require.NoError(t, err)
+		return m
+	}
+	first := send(joined.ID, user.ID, "Deploying the <new> release tonight")
+	send(notJoined.ID, other.ID, "the release is out")
+	second := send(dm.ID, other.ID, "Did the releases go well?")
+	deleted := send(joined.ID, other.ID, "release notes are wrong")
+	_, err = messageMockRepo.DeleteMessage(ctx, deleted.ID)
+	require.NoError(t, err)
+
+	// Only rooms the user is a member of are searched, and words match their stems
+	results, err := messageMockRepo.SearchMessages(ctx, &domain.SearchMessagesReq{UserID: user.ID, Query: "release", Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(results))
+	require.Equal(t, second.ID, results[0].Message.ID)
+	require.Equal(t, first.ID, results[1].Message.ID)
+	require.Equal(t, "Deploying the &lt;new&gt; <mark>release</mark> tonight", results[1].Snippet)
+
+	results, err = messageMockRepo.SearchMessages(ctx, &domain.SearchMessagesReq{UserID: user.ID, Query: "release", Before: second.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(results))
+	require.Equal(t, first.ID, results[0].Message.ID)
+
+	results, err = messageMockRepo.SearchMessages(ctx, &domain.SearchMessagesReq{UserID: user.ID, Query: "release", FromID: other.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(results))
+	require.Equal(t, dm.ID, results[0].Message.RoomID)
+
+	results, err = messageMockRepo.SearchMessages(ctx, &domain.SearchMessagesReq{UserID: user.ID, Query: "release -tonight", RoomID: joined.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(results))
+}
@@ -11,6 +11,8 @@ import (
 
 var userMockRepo port.UserRepoPort
 var chatroomMockRepo port.ChatroomRepoPort
+var messageMockRepo port.MessageRepoPort
+var sessionMockRepo port.SessionRepoPort
 var dbMock *dbTest.DatabaseTest
 
 func TestMain(m *testing.M) {
@@ -21,8 +23,12 @@ func TestMain(m *testing.M) {
 	dbMock = db2
 	chatroomMockRepo = repo.NewChatroomRepository(dbMock.GetDB())
 	userMockRepo = repo.NewUserRepository(dbMock.GetDB())
+	messageMockRepo = repo.NewMessageRepository(dbMock.GetDB())
+	sessionMockRepo = repo.NewSessionRepository(dbMock.GetDB())
 	m.Run()
 
+	sessionMockRepo.DeleteSessionAll(context.Background())
+	messageMockRepo.DeleteMessageAll(context.Background())
 	userMockRepo.DeleteUserAll(context.Background())
 	chatroomMockRepo.DeleteChatroomAll(context.Background())
 	dbMock.Close()
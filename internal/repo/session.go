@@ -0,0 +1,228 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"server/internal/domain"
+	"server/internal/port"
+	"time"
+)
+
+type sessionRepository struct {
+	db DBTX
+}
+
+func NewSessionRepository(db DBTX) port.SessionRepoPort {
+	return &sessionRepository{db: db}
+}
+
+// sessionColumns are the columns scanned by scanSession, from sessions joined with users.
+const sessionColumns = "sessions.id, sessions.user_id, users.username, users.role, sessions.device_label, sessions.ip, sessions.user_agent, " +
+	"sessions.created_at, sessions.last_used_at, sessions.revoked_at"
+
+func scanSession(row rowScanner) (*domain.Session, error) {
+	var s domain.Session
+	var revokedAt sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Username, &s.Role, &s.DeviceLabel, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return &s, nil
+}
+
+// CreateSession starts a session for the user with its first refresh token.
+func (r *sessionRepository) CreateSession(ctx context.Context, session *domain.Session, tokenHash []byte, expiresAt time.Time) (*domain.Session, error) {
+	query := `
+		WITH created AS (
+			INSERT INTO sessions (user_id, device_label, ip, user_agent) VALUES ($1, $2, $3, $4)
+			RETURNING *
+		), token AS (
+			INSERT INTO refresh_tokens (token_hash, session_id, expires_at)
+			SELECT $5, id, $6 FROM created
+		)
+		SELECT ` + sessionColumns + `
+		FROM created AS sessions JOIN users ON users.id = sessions.user_id
+	`
+	s, err := scanSession(r.db.QueryRowContext(ctx, query, session.UserID, session.DeviceLabel, session.IP, session.UserAgent, tokenHash, expiresAt))
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return s, nil
+}
+
+// RotateRefreshToken exchanges an unused, unexpired refresh token of a live
+// session for newHash. A token is only accepted once: presenting it again means
+// it was stolen, or the thief already used it, so the whole session is revoked.
+func (r *sessionRepository) RotateRefreshToken(ctx context.Context, tokenHash, newHash []byte, expiresAt time.Time) (*domain.Session, error) {
+	query := `
+		WITH used AS (
+			UPDATE refresh_tokens SET used_at = now()
+			FROM sessions
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+				AND sessions.id = refresh_tokens.session_id AND sessions.revoked_at IS NULL
+			RETURNING session_id
+		), refreshed AS (
+			UPDATE sessions SET last_used_at = now()
+			FROM used WHERE sessions.id = used.session_id
+			RETURNING sessions.*
+		), token AS (
+			INSERT INTO refresh_tokens (token_hash, session_id, expires_at)
+			SELECT $2, id, $3 FROM refreshed
+		)
+		SELECT ` + sessionColumns + `
+		FROM refreshed AS sessions JOIN users ON users.id = sessions.user_id
+	`
+	s, err := scanSession(r.db.QueryRowContext(ctx, query, tokenHash, newHash, expiresAt))
+	if err == nil {
+		return s, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+
+	// Find out why the token was refused
+	var sessionID int64
+	var used bool
+	err = r.db.QueryRowContext(ctx, "SELECT session_id, used_at IS NOT NULL FROM refresh_tokens WHERE token_hash = $1", tokenHash).Scan(&sessionID, &used)
+	if err == sql.ErrNoRows || err == nil && !used {
+		return nil, domain.ErrInvalidRefreshToken.With("refresh token is invalid or expired")
+	}
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	_, err = r.db.ExecContext(ctx, "UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", sessionID)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return nil, domain.ErrRefreshTokenReused.With("refresh token of session %d was used twice, the session is revoked", sessionID)
+}
+
+func (r *sessionRepository) GetSession(ctx context.Context, id int64) (*domain.Session, error) {
+	query := "SELECT " + sessionColumns + " FROM sessions JOIN users ON users.id = sessions.user_id WHERE sessions.id = $1"
+	s, err := scanSession(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrSessionNotFound.With("session with id %d not found", id)
+	}
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return s, nil
+}
+
+// GetSessions returns the sessions of the user that can still be refreshed,
+// most recently used first.
+func (r *sessionRepository) GetSessions(ctx context.Context, userID int64) ([]*domain.Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.user_id = $1 AND sessions.revoked_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens
+			WHERE refresh_tokens.session_id = sessions.id AND refresh_tokens.used_at IS NULL AND refresh_tokens.expires_at > now()
+		)
+		ORDER BY sessions.last_used_at DESC, sessions.id DESC
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	sessions := []*domain.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends a session of the user. Revoking it again changes nothing.
+func (r *sessionRepository) RevokeSession(ctx context.Context, userID, id int64) error {
+	query := "UPDATE sessions SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND user_id = $2"
+	res, err := r.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return domain.ErrSessionNotFound.With("session with id %d not found", id)
+	}
+	return nil
+}
+
+// RevokeSessions ends every session of the user and returns the ones that were still live.
+func (r *sessionRepository) RevokeSessions(ctx context.Context, userID int64) ([]int64, error) {
+	query := "UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL RETURNING id"
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, domain.ErrInternal.From(err.Error(), err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return ids, nil
+}
+
+// CreateTicket stores a WebSocket ticket for the session, clearing out expired ones.
+func (r *sessionRepository) CreateTicket(ctx context.Context, sessionID int64, ticketHash []byte, expiresAt time.Time) error {
+	query := `
+		WITH expired AS (
+			DELETE FROM ws_tickets WHERE expires_at <= now()
+		)
+		INSERT INTO ws_tickets (ticket_hash, session_id, expires_at) VALUES ($1, $2, $3)
+	`
+	_, err := r.db.ExecContext(ctx, query, ticketHash, sessionID, expiresAt)
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	return nil
+}
+
+// RedeemTicket uses up a ticket and returns its session, which may have been
+// revoked since. Expired tickets are refused.
+func (r *sessionRepository) RedeemTicket(ctx context.Context, ticketHash []byte) (*domain.Session, error) {
+	query := `
+		WITH redeemed AS (
+			DELETE FROM ws_tickets WHERE ticket_hash = $1
+			RETURNING session_id, expires_at
+		)
+		SELECT ` + sessionColumns + `
+		FROM redeemed
+		JOIN sessions ON sessions.id = redeemed.session_id
+		JOIN users ON users.id = sessions.user_id
+		WHERE redeemed.expires_at > now()
+	`
+	s, err := scanSession(r.db.QueryRowContext(ctx, query, ticketHash))
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrInvalidTicket.With("ticket is invalid, used or expired")
+	}
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	return s, nil
+}
+
+func (r *sessionRepository) DeleteSessionAll(ctx context.Context) error { // Testing purposes
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sessions")
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package repo_test
+
+import (
+	"context"
+	"server/internal/domain"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "refresher",
+		Email:    "emailRefresh1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	expiresAt := time.Now().Add(time.Hour)
+	session, err := sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID}, []byte("token1"), expiresAt)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, session.UserID)
+	require.Equal(t, "refresher", session.Username)
+	require.Nil(t, session.RevokedAt)
+
+	rotated, err := sessionMockRepo.RotateRefreshToken(ctx, []byte("token1"), []byte("token2"), expiresAt)
+	require.NoError(t, err)
+	require.Equal(t, session.ID, rotated.ID)
+
+	_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("unknown"), []byte("token3"), expiresAt)
+	require.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+
+	// Replaying a used token revokes the session, and with it the newest token
+	_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("token1"), []byte("token3"), expiresAt)
+	require.ErrorIs(t, err, domain.ErrRefreshTokenReused)
+	revoked, err := sessionMockRepo.GetSession(ctx, session.ID)
+	require.NoError(t, err)
+	require.NotNil(t, revoked.RevokedAt)
+	_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("token2"), []byte("token3"), expiresAt)
+	require.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+}
+
+func TestRefreshTokenExpires(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "refresher2",
+		Email:    "emailRefresh2",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	_, err = sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID}, []byte("expired"), time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("expired"), []byte("next"), time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+}
+
+func TestRevokeSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "revoker",
+		Email:    "emailRevoke1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	session, err := sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID}, []byte("revoked1"), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, sessionMockRepo.RevokeSession(ctx, user.ID, session.ID))
+	require.NoError(t, sessionMockRepo.RevokeSession(ctx, user.ID, session.ID))
+
+	// The token of a revoked session stays unused, so trying it again is not a reuse
+	for i := 0; i < 2; i++ {
+		_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("revoked1"), []byte("revoked2"), time.Now().Add(time.Hour))
+		require.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+		require.NotErrorIs(t, err, domain.ErrRefreshTokenReused)
+	}
+
+	err = sessionMockRepo.RevokeSession(ctx, user.ID, -1)
+	require.ErrorIs(t, err, domain.ErrSessionNotFound)
+	_, err = sessionMockRepo.GetSession(ctx, -1)
+	require.ErrorIs(t, err, domain.ErrSessionNotFound)
+}
+
+func TestGetAndRevokeSessions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "traveller",
+		Email:    "emailSessions1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+	other, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "traveller2",
+		Email:    "emailSessions2",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	expiresAt := time.Now().Add(time.Hour)
+	phone, err := sessionMockRepo.CreateSession(ctx, &domain.Session{
+		UserID:      user.ID,
+		DeviceLabel: "phone",
+		IP:          "10.0.0.1",
+		UserAgent:   "PhoneBrowser/1.0",
+	}, []byte("phone1"), expiresAt)
+	require.NoError(t, err)
+	require.Equal(t, "phone", phone.DeviceLabel)
+	require.Equal(t, "10.0.0.1", phone.IP)
+	laptop, err := sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID, DeviceLabel: "laptop"}, []byte("laptop1"), expiresAt)
+	require.NoError(t, err)
+	_, err = sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID}, []byte("stale1"), time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	_, err = sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: other.ID}, []byte("other1"), expiresAt)
+	require.NoError(t, err)
+
+	// Refreshing moves the phone to the top, sessions that expired are not listed
+	_, err = sessionMockRepo.RotateRefreshToken(ctx, []byte("phone1"), []byte("phone2"), expiresAt)
+	require.NoError(t, err)
+	sessions, err := sessionMockRepo.GetSessions(ctx, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sessions))
+	require.Equal(t, phone.ID, sessions[0].ID)
+	require.Equal(t, "PhoneBrowser/1.0", sessions[0].UserAgent)
+	require.Equal(t, laptop.ID, sessions[1].ID)
+
+	// Users cannot revoke each other's sessions
+	err = sessionMockRepo.RevokeSession(ctx, other.ID, phone.ID)
+	require.ErrorIs(t, err, domain.ErrSessionNotFound)
+
+	require.NoError(t, sessionMockRepo.RevokeSession(ctx, user.ID, laptop.ID))
+	ids, err := sessionMockRepo.RevokeSessions(ctx, user.ID)
+	require.NoError(t, err)
+	require.NotContains(t, ids, laptop.ID)
+	require.Contains(t, ids, phone.ID)
+	sessions, err = sessionMockRepo.GetSessions(ctx, user.ID)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	sessions, err = sessionMockRepo.GetSessions(ctx, other.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sessions))
+}
+
+func TestRedeemTicket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "ticketer",
+		Email:    "emailTicket1",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	session, err := sessionMockRepo.CreateSession(ctx, &domain.Session{UserID: user.ID}, []byte("ticketRefresh"), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	require.NoError(t, sessionMockRepo.CreateTicket(ctx, session.ID, []byte("ticket1"), time.Now().Add(time.Minute)))
+	redeemed, err := sessionMockRepo.RedeemTicket(ctx, []byte("ticket1"))
+	require.NoError(t, err)
+	require.Equal(t, session.ID, redeemed.ID)
+	require.Equal(t, "ticketer", redeemed.Username)
+
+	// A ticket works once
+	_, err = sessionMockRepo.RedeemTicket(ctx, []byte("ticket1"))
+	require.ErrorIs(t, err, domain.ErrInvalidTicket)
+
+	require.NoError(t, sessionMockRepo.CreateTicket(ctx, session.ID, []byte("ticket2"), time.Now().Add(-time.Second)))
+	_, err = sessionMockRepo.RedeemTicket(ctx, []byte("ticket2"))
+	require.ErrorIs(t, err, domain.ErrInvalidTicket)
+}
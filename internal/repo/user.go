@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"server/internal/domain"
 	"server/internal/port"
+	"time"
 )
 
 type DBTX interface {
@@ -38,24 +39,22 @@ func (r *userRepository) CreateUser(ctx context.Context, user *domain.User) (*do
 	}
 
 	query := `
-		INSERT INTO users (username, email, password)
-		VALUES ($1, $2, $3)
-		RETURNING id
+		INSERT INTO users (username, email, password, role)
+		VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), 'user')::userRole)
+		RETURNING id, role
 	`
-	var id int64
-	err = r.db.QueryRowContext(ctx, query, user.Username, user.Email, user.Password).Scan(&id)
+	err = r.db.QueryRowContext(ctx, query, user.Username, user.Email, user.Password, user.Role).Scan(&user.ID, &user.Role)
 	if err != nil {
 		return &domain.User{}, domain.ErrInternal.From(err.Error(), err)
 	}
 
-	user.ID = id
 	return user, nil
 }
 
 func (r *userRepository) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
 	u := domain.User{}
-	query := "SELECT id, email, username, password FROM users WHERE email = $1"
-	err := r.db.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.Email, &u.Username, &u.Password)
+	query := "SELECT id, email, username, password, role FROM users WHERE email = $1"
+	err := r.db.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.Email, &u.Username, &u.Password, &u.Role)
 	if err != nil {
 		return &domain.User{}, nil
 	}
@@ -106,7 +105,7 @@ func (r *userRepository) UpdatePassword(ctx context.Context, id int64, password
 }
 
 func (r *userRepository) GetAllUsers(ctx context.Context) ([]*domain.PublicUser, error) {
-	query := "SELECT id, email, username FROM users"
+	query := "SELECT id, email, username, role FROM users"
 	rows, err := r.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, domain.ErrInternal.From(err.Error(), err)
@@ -115,7 +114,7 @@ func (r *userRepository) GetAllUsers(ctx context.Context) ([]*domain.PublicUser,
 	var users []*domain.PublicUser
 	for rows.Next() {
 		u := domain.PublicUser{}
-		err := rows.Scan(&u.ID, &u.Email, &u.Username)
+		err := rows.Scan(&u.ID, &u.Email, &u.Username, &u.Role)
 		if err != nil {
 			return nil, domain.ErrInternal.From(err.Error(), err)
 		}
@@ -125,6 +124,75 @@ func (r *userRepository) GetAllUsers(ctx context.Context) ([]*domain.PublicUser,
 	return users, nil
 }
 
+func (r *userRepository) UpdateRole(ctx context.Context, id int64, role string) error {
+	query := "UPDATE users SET role = $1 WHERE id = $2"
+	res, err := r.db.ExecContext(ctx, query, role, id)
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return domain.ErrUserIDNotFound.With("user with id %d does not exist", id)
+	}
+	return nil
+}
+
+// PromoteFirstAdmin makes the user with the email an admin if there is no admin
+// yet, and reports whether it did.
+func (r *userRepository) PromoteFirstAdmin(ctx context.Context, email string) (bool, error) {
+	query := `
+		UPDATE users SET role = 'admin'
+		WHERE email = $1 AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin')
+	`
+	res, err := r.db.ExecContext(ctx, query, email)
+	if err != nil {
+		return false, domain.ErrInternal.From(err.Error(), err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, domain.ErrInternal.From(err.Error(), err)
+	}
+	return n == 1, nil
+}
+
+func (r *userRepository) GetRole(ctx context.Context, id int64) (string, error) {
+	query := "SELECT role FROM users WHERE id = $1"
+	var role string
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", domain.ErrUserIDNotFound.With("user with id %d does not exist", id)
+	}
+	if err != nil {
+		return "", domain.ErrInternal.From(err.Error(), err)
+	}
+	return role, nil
+}
+
+func (r *userRepository) UpdateLastSeen(ctx context.Context, id int64, at time.Time) error {
+	query := "UPDATE users SET last_seen = $1 WHERE id = $2"
+	_, err := r.db.ExecContext(ctx, query, at, id)
+	if err != nil {
+		return domain.ErrInternal.From(err.Error(), err)
+	}
+	return nil
+}
+
+// GetLastSeen returns when the user last disconnected, or nil if they never connected.
+func (r *userRepository) GetLastSeen(ctx context.Context, id int64) (*time.Time, error) {
+	query := "SELECT last_seen FROM users WHERE id = $1"
+	var lastSeen sql.NullTime
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, domain.ErrUserIDNotFound.With("user with id %d does not exist", id)
+	}
+	if err != nil {
+		return nil, domain.ErrInternal.From(err.Error(), err)
+	}
+	if !lastSeen.Valid {
+		return nil, nil
+	}
+	return &lastSeen.Time, nil
+}
+
 func (r *userRepository) DeleteAllUsers(ctx context.Context) error {
 	query := "DELETE FROM users"
 	_, err := r.db.ExecContext(ctx, query)
@@ -151,6 +151,100 @@ func TestUpdatePassword(t *testing.T) {
 	require.Equal(t, user2.Password, "password_new")
 }
 
+func TestUpdateLastSeen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "username40",
+		Email:    "email40",
+		Password: "password40",
+	})
+	require.NoError(t, err)
+
+	lastSeen, err := userMockRepo.GetLastSeen(ctx, user.ID)
+	require.NoError(t, err)
+	require.Nil(t, lastSeen)
+
+	now := time.Now()
+	err = userMockRepo.UpdateLastSeen(ctx, user.ID, now)
+	require.NoError(t, err)
+
+	lastSeen, err = userMockRepo.GetLastSeen(ctx, user.ID)
+	require.NoError(t, err)
+	require.WithinDuration(t, now, *lastSeen, time.Millisecond)
+
+	_, err = userMockRepo.GetLastSeen(ctx, -1)
+	require.ErrorIs(t, err, domain.ErrUserIDNotFound)
+}
+
+func TestUpdateRole(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "username50",
+		Email:    "email50",
+		Password: "password50",
+	})
+	require.NoError(t, err)
+
+	role, err := userMockRepo.GetRole(ctx, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.RoleUser, role)
+
+	require.NoError(t, userMockRepo.UpdateRole(ctx, user.ID, domain.RoleAdmin))
+	role, err = userMockRepo.GetRole(ctx, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.RoleAdmin, role)
+
+	user2, err := userMockRepo.GetUserByEmail(ctx, "email50")
+	require.NoError(t, err)
+	require.Equal(t, domain.RoleAdmin, user2.Role)
+
+	err = userMockRepo.UpdateRole(ctx, -1, domain.RoleAdmin)
+	require.ErrorIs(t, err, domain.ErrUserIDNotFound)
+	_, err = userMockRepo.GetRole(ctx, -1)
+	require.ErrorIs(t, err, domain.ErrUserIDNotFound)
+}
+
+func TestPromoteFirstAdmin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userMockRepo.DeleteUserAll(ctx)
+
+	first, err := userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "username60",
+		Email:    "email60",
+		Password: "password60",
+	})
+	require.NoError(t, err)
+	_, err = userMockRepo.CreateUser(ctx, &domain.User{
+		Username: "username61",
+		Email:    "email61",
+		Password: "password61",
+	})
+	require.NoError(t, err)
+
+	promoted, err := userMockRepo.PromoteFirstAdmin(ctx, "nobody60")
+	require.NoError(t, err)
+	require.False(t, promoted)
+
+	promoted, err = userMockRepo.PromoteFirstAdmin(ctx, "email60")
+	require.NoError(t, err)
+	require.True(t, promoted)
+
+	// Nobody is promoted while there is an admin, only once none is left
+	promoted, err = userMockRepo.PromoteFirstAdmin(ctx, "email61")
+	require.NoError(t, err)
+	require.False(t, promoted)
+	require.NoError(t, userMockRepo.UpdateRole(ctx, first.ID, domain.RoleUser))
+	promoted, err = userMockRepo.PromoteFirstAdmin(ctx, "email61")
+	require.NoError(t, err)
+	require.True(t, promoted)
+}
+
 func TestGetAllUsers(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -26,6 +26,9 @@ func (s *chatroomService) CreateChatroom(ctx context.Context, req *domain.Create
 	c := &domain.Chatroom{
 		Name: req.Name,
 	}
+	if req.CreatorID != 0 {
+		c.Moderators = []int64{req.CreatorID}
+	}
 
 	r, err := s.ChatroomRepoPort.CreateChatroom(ctx, c)
 	if err != nil {
@@ -99,10 +102,12 @@ func (s *chatroomService) GetChatroomByID(ctx context.Context, req *domain.GetCh
 	}
 
 	res := &domain.GetChatroomByIDRes{
-		ID:       r.ID,
-		Name:     r.Name,
-		Clients:  r.Clients,
-		Category: r.Category,
+		ID:         r.ID,
+		Name:       r.Name,
+		Clients:    r.Clients,
+		Category:   r.Category,
+		Moderators: r.Moderators,
+		Pins:       r.Pins,
 	}
 	return res, nil
 }
@@ -119,24 +124,43 @@ func (s *chatroomService) UpdateChatroomName(ctx context.Context, req *domain.Up
 	return nil
 }
 
-func (s *chatroomService) GetAllChatrooms(ctx context.Context, userID int64) ([]*domain.Chatroom, error) {
+// GetAllChatrooms returns a page of the public rooms, sorted by name unless
+// another order is requested.
+func (s *chatroomService) GetAllChatrooms(ctx context.Context, req *domain.GetRoomsReq) (*domain.GetRoomsRes, error) {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	r, err := s.ChatroomRepoPort.GetAllChatrooms(ctx, userID)
+	if req.Sort == "" {
+		req.Sort = domain.RoomSortName
+	}
+	if req.Limit <= 0 {
+		req.Limit = domain.DefaultRoomLimit
+	}
+	if req.Limit > domain.MaxRoomLimit {
+		req.Limit = domain.MaxRoomLimit
+	}
+
+	r, err := s.ChatroomRepoPort.GetAllChatrooms(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	res := []*domain.Chatroom{}
+	res := &domain.GetRoomsRes{Rooms: []*domain.Chatroom{}}
 	for _, c := range r {
-		res = append(res, &domain.Chatroom{
-			ID:       c.ID,
-			Name:     c.Name,
-			Clients:  c.Clients,
-			Category: c.Category,
+		res.Rooms = append(res.Rooms, &domain.Chatroom{
+			ID:             c.ID,
+			Name:           c.Name,
+			Clients:        c.Clients,
+			Category:       c.Category,
+			UnreadCount:    c.UnreadCount,
+			LastMessage:    c.LastMessage,
+			MemberCount:    c.MemberCount,
+			LastActivityAt: c.LastActivityAt,
 		})
 	}
+	if len(r) == req.Limit {
+		res.NextCursor = domain.NewRoomCursor(req.Sort, r[len(r)-1]).String()
+	}
 
 	return res, nil
 }
@@ -153,10 +177,14 @@ func (s *chatroomService) GetAllDMs(ctx context.Context, userID int64) ([]*domai
 	res := []*domain.Chatroom{}
 	for _, c := range r {
 		res = append(res, &domain.Chatroom{
-			ID:       c.ID,
-			Name:     c.Name,
-			Clients:  c.Clients,
-			Category: c.Category,
+			ID:             c.ID,
+			Name:           c.Name,
+			Clients:        c.Clients,
+			Category:       c.Category,
+			UnreadCount:    c.UnreadCount,
+			LastMessage:    c.LastMessage,
+			MemberCount:    c.MemberCount,
+			LastActivityAt: c.LastActivityAt,
 		})
 	}
 
@@ -1,69 +0,0 @@
-package service
-
-import (
-	"fmt"
-	"os"
-	"time"
-
-	"github.com/golang-jwt/jwt/v4"
-)
-
-type JWTService interface {
-	GenerateToken(email string, isUser bool) string
-	ValidateToken(token string) (*jwt.Token, error)
-}
-
-type authCustomClaims struct {
-	Name string `json:"name"`
-	User bool   `json:"user"`
-	jwt.StandardClaims
-}
-
-type jwtServices struct {
-	secretKey string
-	issure    string
-}
-
-func JWTAuthService() JWTService {
-	return &jwtServices{
-		secretKey: getSecretKey(),
-		issure:    "Bikash",
-	}
-}
-
-func getSecretKey() string {
-	secret := os.Getenv("SECRET")
-	if secret == "" {
-		secret = "secret"
-	}
-	return secret
-}
-
-func (service *jwtServices) GenerateToken(email string, isUser bool) string {
-	claims := &authCustomClaims{
-		email,
-		isUser,
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
-			Issuer:    service.issure,
-			IssuedAt:  time.Now().Unix(),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	t, err := token.SignedString([]byte(service.secretKey))
-	if err != nil {
-		panic(err)
-	}
-	return t
-}
-
-func (service *jwtServices) ValidateToken(encodedToken string) (*jwt.Token, error) {
-	return jwt.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, isvalid := token.Method.(*jwt.SigningMethodHMAC); !isvalid {
-			return nil, fmt.Errorf("Invalid token", token.Header["alg"])
-
-		}
-		return []byte(service.secretKey), nil
-	})
-}
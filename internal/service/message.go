@@ -0,0 +1,441 @@
+package service
+
+import (
+	"context"
+	"server/internal/domain"
+	"server/internal/port"
+	"time"
+)
+
+type messageService struct {
+	port.MessageRepoPort
+	chatroomRepo port.ChatroomRepoPort
+	userRepo     port.UserRepoPort
+	timeout      time.Duration
+}
+
+func NewMessageService(repo port.MessageRepoPort, chatroomRepo port.ChatroomRepoPort, userRepo port.UserRepoPort) port.MessageServicePort {
+	return &messageService{
+		repo,
+		chatroomRepo,
+		userRepo,
+		time.Duration(2) * time.Second,
+	}
+}
+
+func (s *messageService) SaveMessage(ctx context.Context, message *domain.ChatMessage) (*domain.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	m, err := s.MessageRepoPort.CreateMessage(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (s *messageService) GetMessage(ctx context.Context, id int64) (*domain.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	m, err := s.MessageRepoPort.GetMessageByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GetMessagesSince returns up to limit messages of the room with a sequence number
+// greater than since, in order. It is used to replay what a client missed.
+func (s *messageService) GetMessagesSince(ctx context.Context, roomID int64, since int64, limit int) ([]*domain.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	messages, err := s.MessageRepoPort.GetMessagesSince(ctx, roomID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (s *messageService) GetMessages(ctx context.Context, req *domain.GetMessagesReq) (*domain.GetMessagesRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Category == domain.Private && !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, req.RoomID)
+	}
+
+	limit := pageLimit(req.Limit)
+	messages, err := s.MessageRepoPort.GetMessagesByRoom(ctx, req.RoomID, req.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	res := &domain.GetMessagesRes{
+		Messages: messages,
+	}
+	if len(messages) == limit {
+		res.NextBefore = messages[0].ID
+	}
+	return res, nil
+}
+
+// GetThread returns a page of the replies to a message together with the message itself.
+func (s *messageService) GetThread(ctx context.Context, req *domain.GetThreadReq) (*domain.GetThreadRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Category == domain.Private && !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, req.RoomID)
+	}
+
+	parent, err := s.MessageRepoPort.GetMessageByID(ctx, req.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	if parent.RoomID != req.RoomID || parent.ParentID != 0 {
+		return nil, domain.ErrMessageIDNotFound.With("message with id %d does not start a thread in chatroom with id %d", req.MessageID, req.RoomID)
+	}
+
+	limit := pageLimit(req.Limit)
+	replies, err := s.MessageRepoPort.GetReplies(ctx, req.MessageID, req.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addReactions(ctx, append([]*domain.ChatMessage{parent}, replies...)); err != nil {
+		return nil, err
+	}
+
+	res := &domain.GetThreadRes{
+		Parent:  parent,
+		Replies: replies,
+	}
+	if len(replies) == limit {
+		res.NextBefore = replies[0].ID
+	}
+	return res, nil
+}
+
+// GetMentions returns a page of the user's mention inbox, newest first.
+func (s *messageService) GetMentions(ctx context.Context, req *domain.GetMentionsReq) (*domain.GetMentionsRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	limit := pageLimit(req.Limit)
+	mentions, err := s.MessageRepoPort.GetMentions(ctx, req.UserID, req.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addReactions(ctx, mentions); err != nil {
+		return nil, err
+	}
+
+	res := &domain.GetMentionsRes{
+		Mentions: mentions,
+	}
+	if len(mentions) == limit {
+		res.NextBefore = mentions[len(mentions)-1].ID
+	}
+	return res, nil
+}
+
+// SearchMessages returns a page of the messages matching a search in the rooms
+// the user is a member of, newest first.
+func (s *messageService) SearchMessages(ctx context.Context, req *domain.SearchMessagesReq) (*domain.SearchMessagesRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	req.Limit = pageLimit(req.Limit)
+	results, err := s.MessageRepoPort.SearchMessages(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*domain.ChatMessage, len(results))
+	for i, result := range results {
+		messages[i] = result.Message
+	}
+	if err := s.addReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	res := &domain.SearchMessagesRes{
+		Results: results,
+	}
+	if len(results) == req.Limit {
+		res.NextBefore = results[len(results)-1].Message.ID
+	}
+	return res, nil
+}
+
+// pageLimit applies the default and maximum page size to a requested limit.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return domain.DefaultMessageLimit
+	}
+	if limit > domain.MaxMessageLimit {
+		return domain.MaxMessageLimit
+	}
+	return limit
+}
+
+// MarkRead moves the user's read marker for a room they are a member of.
+func (s *messageService) MarkRead(ctx context.Context, req *domain.MarkReadReq) (*domain.ReadReceipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, req.RoomID)
+	}
+
+	receipt, err := s.MessageRepoPort.MarkRead(ctx, req.UserID, req.RoomID, req.Seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// EditMessage replaces the content of a message on behalf of its sender or a
+// moderator of its room, keeping the previous content in the edit history.
+func (s *messageService) EditMessage(ctx context.Context, req *domain.EditMessageReq) (*domain.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.checkEditor(ctx, req.ID, req.UserID); err != nil {
+		return nil, err
+	}
+
+	m, err := s.MessageRepoPort.EditMessage(ctx, req.ID, req.UserID, req.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// DeleteMessage replaces a message with a tombstone on behalf of its sender or a
+// moderator of its room.
+func (s *messageService) DeleteMessage(ctx context.Context, req *domain.DeleteMessageReq) (*domain.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.checkEditor(ctx, req.ID, req.UserID); err != nil {
+		return nil, err
+	}
+
+	m, err := s.MessageRepoPort.DeleteMessage(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GetMessageEdits returns the earlier versions of a message to a user who may read its room.
+func (s *messageService) GetMessageEdits(ctx context.Context, req *domain.GetMessageEditsReq) ([]*domain.MessageEdit, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	m, err := s.MessageRepoPort.GetMessageByID(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, m.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Category == domain.Private && !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, m.RoomID)
+	}
+
+	edits, err := s.MessageRepoPort.GetMessageEdits(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return edits, nil
+}
+
+// React adds or removes a reaction to a message on behalf of a member of its room.
+func (s *messageService) React(ctx context.Context, req *domain.ReactReq) (*domain.Reaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	m, err := s.MessageRepoPort.GetMessageByID(ctx, req.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, m.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, m.RoomID)
+	}
+
+	react := s.MessageRepoPort.AddReaction
+	if req.Remove {
+		react = s.MessageRepoPort.RemoveReaction
+	}
+	reaction, err := react(ctx, req.MessageID, req.UserID, req.Emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	return reaction, nil
+}
+
+// addReactions fills in the reaction counts of the messages.
+func (s *messageService) addReactions(ctx context.Context, messages []*domain.ChatMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	reactions, err := s.MessageRepoPort.GetReactions(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		m.Reactions = reactions[m.ID]
+	}
+	return nil
+}
+
+// checkEditor makes sure the user sent the message or moderates its room.
+func (s *messageService) checkEditor(ctx context.Context, messageID int64, userID int64) error {
+	m, err := s.MessageRepoPort.GetMessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if m.SenderID == userID {
+		return nil
+	}
+
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, m.RoomID)
+	if err != nil {
+		return err
+	}
+	ok, err := s.isModerator(ctx, room, userID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return domain.ErrNotMessageEditor.With("user with id %d may not change message with id %d", userID, messageID)
+}
+
+// PinMessage pins a message of the room on behalf of a moderator.
+func (s *messageService) PinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.checkModerator(ctx, req.RoomID, req.UserID); err != nil {
+		return nil, err
+	}
+
+	pin, err := s.MessageRepoPort.PinMessage(ctx, req.RoomID, req.MessageID, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pin, nil
+}
+
+// UnpinMessage removes a pin of the room on behalf of a moderator.
+func (s *messageService) UnpinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.checkModerator(ctx, req.RoomID, req.UserID); err != nil {
+		return nil, err
+	}
+
+	pin, err := s.MessageRepoPort.UnpinMessage(ctx, req.RoomID, req.MessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pin, nil
+}
+
+// GetPins returns the pins of a room to a user who may read it.
+func (s *messageService) GetPins(ctx context.Context, req *domain.GetPinsReq) ([]*domain.Pin, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Category == domain.Private && !isRoomMember(room.Clients, req.UserID) {
+		return nil, domain.ErrNotChatroomMember.With("user with id %d is not a member of chatroom with id %d", req.UserID, req.RoomID)
+	}
+
+	return room.Pins, nil
+}
+
+func (s *messageService) checkModerator(ctx context.Context, roomID int64, userID int64) error {
+	room, err := s.chatroomRepo.GetChatroomByID(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	ok, err := s.isModerator(ctx, room, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return domain.ErrNotRoomModerator.With("user with id %d does not moderate chatroom with id %d", userID, roomID)
+	}
+	return nil
+}
+
+// isModerator reports whether the user moderates the room, as one of its
+// moderators or with a role that moderates every room.
+func (s *messageService) isModerator(ctx context.Context, room *domain.GetRoomByIDRepo, userID int64) (bool, error) {
+	for _, id := range room.Moderators {
+		if id == userID {
+			return true, nil
+		}
+	}
+	role, err := s.userRepo.GetRole(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return domain.RoleCan(role, domain.PermModerateRooms), nil
+}
+
+func isRoomMember(clients []domain.PublicUser, userID int64) bool {
+	for _, c := range clients {
+		if c.ID == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"server/internal/port"
+	"time"
+)
+
+type presenceService struct {
+	userRepo     port.UserRepoPort
+	chatroomRepo port.ChatroomRepoPort
+	timeout      time.Duration
+}
+
+func NewPresenceService(userRepo port.UserRepoPort, chatroomRepo port.ChatroomRepoPort) port.PresenceServicePort {
+	return &presenceService{
+		userRepo,
+		chatroomRepo,
+		time.Duration(2) * time.Second,
+	}
+}
+
+// GetContacts returns the users who should be told about the user's presence.
+func (s *presenceService) GetContacts(ctx context.Context, userID int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	contacts, err := s.chatroomRepo.GetContacts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return contacts, nil
+}
+
+func (s *presenceService) UpdateLastSeen(ctx context.Context, userID int64, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.userRepo.UpdateLastSeen(ctx, userID, at)
+}
+
+func (s *presenceService) GetLastSeen(ctx context.Context, userID int64) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	lastSeen, err := s.userRepo.GetLastSeen(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return lastSeen, nil
+}
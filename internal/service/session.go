@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"server/internal/domain"
+	"server/internal/port"
+	"time"
+)
+
+// wsTicketTTL is how long a WebSocket ticket can be used: just long enough to open the connection.
+const wsTicketTTL = 30 * time.Second
+
+type sessionService struct {
+	port.SessionRepoPort
+	tokens     port.TokenServicePort
+	refreshTTL time.Duration
+	timeout    time.Duration
+}
+
+func NewSessionService(repo port.SessionRepoPort, tokens port.TokenServicePort, refreshTTL time.Duration) port.SessionServicePort {
+	return &sessionService{
+		repo,
+		tokens,
+		refreshTTL,
+		time.Duration(2) * time.Second,
+	}
+}
+
+// Start opens a session for a user who just logged in on the described device.
+func (s *sessionService) Start(ctx context.Context, user *domain.User, device *domain.Session) (*domain.LoginUserRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	refreshToken, hash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(s.refreshTTL)
+	session, err := s.SessionRepoPort.CreateSession(ctx, &domain.Session{
+		UserID:      user.ID,
+		DeviceLabel: device.DeviceLabel,
+		IP:          device.IP,
+		UserAgent:   device.UserAgent,
+	}, hash, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issue(session, refreshToken, expiresAt)
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// Each refresh token works once; reusing one revokes its session.
+func (s *sessionService) Refresh(ctx context.Context, refreshToken string) (*domain.LoginUserRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	next, hash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(s.refreshTTL)
+	session, err := s.SessionRepoPort.RotateRefreshToken(ctx, hashSecret(refreshToken), hash, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.issue(session, next, expiresAt)
+}
+
+func (s *sessionService) issue(session *domain.Session, refreshToken string, refreshExpiresAt time.Time) (*domain.LoginUserRes, error) {
+	accessToken, claims, err := s.tokens.GenerateToken(&domain.User{ID: session.UserID, Username: session.Username, Role: session.Role}, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.LoginUserRes{
+		AccessToken:      accessToken,
+		ExpiresAt:        claims.ExpiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+		ID:               session.UserID,
+		Username:         session.Username,
+		Role:             session.Role,
+	}, nil
+}
+
+// Authenticate checks an access token and that its session has not been revoked.
+func (s *sessionService) Authenticate(ctx context.Context, accessToken string) (*domain.TokenClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	claims, err := s.tokens.ValidateToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.SessionRepoPort.GetSession(ctx, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.RevokedAt != nil || session.UserID != claims.UserID {
+		return nil, domain.ErrSessionRevoked.With("session with id %d was revoked", session.ID)
+	}
+	// The role may have changed since the token was issued
+	claims.Role = session.Role
+
+	return claims, nil
+}
+
+// GetSessions lists where the user is signed in, flagging the session currentID.
+func (s *sessionService) GetSessions(ctx context.Context, userID, currentID int64) ([]*domain.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	sessions, err := s.SessionRepoPort.GetSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == currentID
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions, with its refresh token and access tokens.
+func (s *sessionService) RevokeSession(ctx context.Context, userID, sessionID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.SessionRepoPort.RevokeSession(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSessions logs the user out everywhere and returns the sessions that ended.
+func (s *sessionService) RevokeSessions(ctx context.Context, userID int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	ids, err := s.SessionRepoPort.RevokeSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// IssueTicket creates a single-use ticket that opens one WebSocket connection
+// for the session, for clients that cannot send a header or cookie with it.
+func (s *sessionService) IssueTicket(ctx context.Context, sessionID int64) (*domain.WSTicket, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	ticket, hash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(wsTicketTTL)
+	if err := s.SessionRepoPort.CreateTicket(ctx, sessionID, hash, expiresAt); err != nil {
+		return nil, err
+	}
+
+	return &domain.WSTicket{Ticket: ticket, ExpiresAt: expiresAt}, nil
+}
+
+// RedeemTicket uses up a ticket, returning who it was issued to if their session is still live.
+func (s *sessionService) RedeemTicket(ctx context.Context, ticket string) (*domain.TokenClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	session, err := s.SessionRepoPort.RedeemTicket(ctx, hashSecret(ticket))
+	if err != nil {
+		return nil, err
+	}
+	if session.RevokedAt != nil {
+		return nil, domain.ErrSessionRevoked.With("session with id %d was revoked", session.ID)
+	}
+
+	return &domain.TokenClaims{UserID: session.UserID, Username: session.Username, SessionID: session.ID, Role: session.Role}, nil
+}
+
+// newSecret returns a random opaque token, used for refresh tokens and tickets,
+// and the hash it is stored under.
+func newSecret() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashSecret(token), nil
+}
+
+func hashSecret(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
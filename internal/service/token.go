@@ -0,0 +1,196 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"server/internal/domain"
+	"server/internal/port"
+	"server/util"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// TokenConfig configures how access tokens are signed and checked.
+type TokenConfig struct {
+	Algorithm string // HS256, RS256 or EdDSA
+	Secret    string // Key of HS256
+	// PEM keys of RS256 and EdDSA. An instance that only checks tokens can be
+	// given the public key alone; otherwise it is derived from the private key.
+	PrivateKeyFile string
+	PublicKeyFile  string
+	Issuer         string
+	Audience       string // Not checked if empty
+	TTL            time.Duration
+	RefreshTTL     time.Duration // How long a session lasts without being refreshed
+}
+
+func DefaultTokenConfig() TokenConfig {
+	return TokenConfig{
+		Algorithm:  "HS256",
+		Issuer:     "server",
+		TTL:        15 * time.Minute,
+		RefreshTTL: 30 * 24 * time.Hour,
+	}
+}
+
+// TokenConfigFromEnv reads the JWT_* environment variables over the defaults.
+// SECRET is still read when JWT_SECRET is not set. There is no default secret.
+func TokenConfigFromEnv() TokenConfig {
+	cfg := DefaultTokenConfig()
+	util.StringFromEnv("JWT_ALGORITHM", &cfg.Algorithm)
+	util.StringFromEnv("SECRET", &cfg.Secret)
+	util.StringFromEnv("JWT_SECRET", &cfg.Secret)
+	util.StringFromEnv("JWT_PRIVATE_KEY_FILE", &cfg.PrivateKeyFile)
+	util.StringFromEnv("JWT_PUBLIC_KEY_FILE", &cfg.PublicKeyFile)
+	util.StringFromEnv("JWT_ISSUER", &cfg.Issuer)
+	util.StringFromEnv("JWT_AUDIENCE", &cfg.Audience)
+	util.DurationFromEnv("JWT_TTL", &cfg.TTL)
+	util.DurationFromEnv("JWT_REFRESH_TTL", &cfg.RefreshTTL)
+	return cfg
+}
+
+// tokenClaims are the claims of an access token. The user ID is a string for
+// the clients that read it from the token.
+type tokenClaims struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	SessionID int64  `json:"sid"`
+	Role      string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type tokenService struct {
+	cfg       TokenConfig
+	method    jwt.SigningMethod
+	signKey   interface{} // nil when the instance only checks tokens
+	verifyKey interface{}
+}
+
+// NewTokenService loads the keys of cfg.Algorithm.
+func NewTokenService(cfg TokenConfig) (port.TokenServicePort, error) {
+	s := &tokenService{cfg: cfg}
+	switch cfg.Algorithm {
+	case "HS256":
+		if cfg.Secret == "" {
+			return nil, errors.New("HS256 tokens need a secret, set JWT_SECRET")
+		}
+		s.method = jwt.SigningMethodHS256
+		s.signKey, s.verifyKey = []byte(cfg.Secret), []byte(cfg.Secret)
+	case "RS256":
+		s.method = jwt.SigningMethodRS256
+		err := s.loadKeys(
+			func(pem []byte) (interface{}, error) { return jwt.ParseRSAPrivateKeyFromPEM(pem) },
+			func(pem []byte) (interface{}, error) { return jwt.ParseRSAPublicKeyFromPEM(pem) },
+			func(key interface{}) interface{} { return &key.(*rsa.PrivateKey).PublicKey },
+		)
+		if err != nil {
+			return nil, err
+		}
+	case "EdDSA":
+		s.method = jwt.SigningMethodEdDSA
+		err := s.loadKeys(
+			func(pem []byte) (interface{}, error) { return jwt.ParseEdPrivateKeyFromPEM(pem) },
+			func(pem []byte) (interface{}, error) { return jwt.ParseEdPublicKeyFromPEM(pem) },
+			func(key interface{}) interface{} { return key.(ed25519.PrivateKey).Public() },
+		)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported token algorithm %q, use HS256, RS256 or EdDSA", cfg.Algorithm)
+	}
+	return s, nil
+}
+
+// loadKeys reads the key files of an asymmetric algorithm.
+func (s *tokenService) loadKeys(parsePrivate, parsePublic func([]byte) (interface{}, error), public func(interface{}) interface{}) error {
+	if s.cfg.PrivateKeyFile == "" && s.cfg.PublicKeyFile == "" {
+		return fmt.Errorf("%s tokens need a private or public key file", s.cfg.Algorithm)
+	}
+	if s.cfg.PrivateKeyFile != "" {
+		key, err := readKey(s.cfg.PrivateKeyFile, parsePrivate)
+		if err != nil {
+			return err
+		}
+		s.signKey, s.verifyKey = key, public(key)
+	}
+	if s.cfg.PublicKeyFile != "" {
+		key, err := readKey(s.cfg.PublicKeyFile, parsePublic)
+		if err != nil {
+			return err
+		}
+		s.verifyKey = key
+	}
+	return nil
+}
+
+func readKey(path string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parse(pem)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func (s *tokenService) GenerateToken(user *domain.User, sessionID int64) (string, *domain.TokenClaims, error) {
+	if s.signKey == nil {
+		return "", nil, errors.New("no private key to sign tokens with")
+	}
+
+	now := time.Now()
+	claims := &tokenClaims{
+		ID:        strconv.FormatInt(user.ID, 10),
+		Username:  user.Username,
+		SessionID: sessionID,
+		Role:      user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			Issuer:    s.cfg.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.TTL)),
+		},
+	}
+	if s.cfg.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{s.cfg.Audience}
+	}
+
+	token, err := jwt.NewWithClaims(s.method, claims).SignedString(s.signKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &domain.TokenClaims{UserID: user.ID, Username: user.Username, SessionID: sessionID, Role: user.Role, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+// ValidateToken checks the signature, algorithm, expiry, issuer and audience of a token.
+func (s *tokenService) ValidateToken(token string) (*domain.TokenClaims, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return s.verifyKey, nil
+	}, jwt.WithValidMethods([]string{s.method.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(s.cfg.Issuer, true) {
+		return nil, fmt.Errorf("token issued by %q", claims.Issuer)
+	}
+	if s.cfg.Audience != "" && !claims.VerifyAudience(s.cfg.Audience, true) {
+		return nil, fmt.Errorf("token is not for %q", s.cfg.Audience)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token does not expire")
+	}
+	userID, err := strconv.ParseInt(claims.ID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("token has an invalid user id %q", claims.ID)
+	}
+	return &domain.TokenClaims{UserID: userID, Username: claims.Username, SessionID: claims.SessionID, Role: claims.Role, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
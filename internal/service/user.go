@@ -5,24 +5,19 @@ import (
 	"server/internal/domain"
 	"server/internal/port"
 	"server/util"
-	"strconv"
 	"time"
-
-	"github.com/golang-jwt/jwt/v4"
-)
-
-const (
-	secretKey = "secret"
 )
 
 type userService struct {
 	port.UserRepoPort
-	timeout time.Duration
+	sessions port.SessionServicePort
+	timeout  time.Duration
 }
 
-func NewUserService(repo port.UserRepoPort) port.UserServicePort {
+func NewUserService(repo port.UserRepoPort, sessions port.SessionServicePort) port.UserServicePort {
 	return &userService{
 		repo,
+		sessions,
 		time.Duration(2) * time.Second,
 	}
 }
@@ -40,6 +35,7 @@ func (s *userService) CreateUser(ctx context.Context, req *domain.CreateUserReq)
 		Username: req.Username,
 		Email:    req.Email,
 		Password: hashedPassword,
+		Role:     domain.RoleUser,
 	}
 
 	r, err := s.UserRepoPort.CreateUser(ctx, u)
@@ -56,12 +52,6 @@ func (s *userService) CreateUser(ctx context.Context, req *domain.CreateUserReq)
 	return res, nil
 }
 
-type MyJWTClaims struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	jwt.RegisteredClaims
-}
-
 func (s *userService) Login(c context.Context, req *domain.LoginUserReq) (*domain.LoginUserRes, error) {
 	ctx, cancel := context.WithTimeout(c, s.timeout)
 	defer cancel()
@@ -76,25 +66,16 @@ func (s *userService) Login(c context.Context, req *domain.LoginUserReq) (*domai
 		return &domain.LoginUserRes{}, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, MyJWTClaims{
-		ID:       strconv.Itoa(int(u.ID)),
-		Username: u.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    strconv.Itoa(int(u.ID)),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
+	res, err := s.sessions.Start(ctx, u, &domain.Session{
+		DeviceLabel: req.DeviceLabel,
+		IP:          req.IP,
+		UserAgent:   req.UserAgent,
 	})
-
-	ss, err := token.SignedString([]byte(secretKey))
 	if err != nil {
 		return &domain.LoginUserRes{}, err
 	}
 
-	return &domain.LoginUserRes{
-		AccessToken: ss, 
-		Username: u.Username, 
-		ID: u.ID,
-	}, nil
+	return res, nil
 }
 
 func (s *userService) UpdateUser(ctx context.Context, req *domain.UpdateUsernameReq) error {
@@ -138,6 +119,38 @@ func (s *userService) GetAllUsers(ctx context.Context) ([]*domain.PublicUser, er
 	return users, nil
 }
 
+// UpdateRole changes a user's role. It applies to their next request, as
+// requests are checked against the role currently stored.
+func (s *userService) UpdateRole(ctx context.Context, req *domain.UpdateRoleReq) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if !domain.ValidRole(req.Role) {
+		return domain.ErrInvalidRole.With("role must be %s, %s or %s", domain.RoleUser, domain.RoleModerator, domain.RoleAdmin)
+	}
+
+	err := s.UserRepoPort.UpdateRole(ctx, req.ID, req.Role)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// BootstrapAdmin makes the existing user with the email the first admin. It does
+// nothing once there is an admin, so that admin can later be demoted.
+func (s *userService) BootstrapAdmin(ctx context.Context, email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	promoted, err := s.UserRepoPort.PromoteFirstAdmin(ctx, email)
+	if err != nil {
+		return false, err
+	}
+
+	return promoted, nil
+}
+
 func (s *userService) DeleteAllUsers(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// publishTimeout bounds how long the hub waits on the broker for each message.
+const publishTimeout = 2 * time.Second
+
+// Broker carries room traffic between hub instances. A hub delivers what it
+// sends to its own clients directly and publishes it for every other instance;
+// Messages yields what the other instances published, with origin and recipients set.
+type Broker interface {
+	Publish(ctx context.Context, message *Message) error
+	Messages() <-chan *Message
+	Close() error
+}
+
+// MemoryBroker connects hubs running in the same process. With a single node it
+// is the broker of a server that runs on its own; tests use several nodes to
+// stand in for several servers.
+type MemoryBroker struct {
+	mu    sync.Mutex
+	nodes map[*memoryNode]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		nodes: make(map[*memoryNode]struct{}),
+	}
+}
+
+// Node returns the Broker for one hub attached to this broker.
+func (b *MemoryBroker) Node() Broker {
+	n := &memoryNode{
+		id:     newSessionID(),
+		broker: b,
+		in:     make(chan *Message),
+		out:    make(chan *Message),
+		done:   make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.nodes[n] = struct{}{}
+	b.mu.Unlock()
+
+	go n.run()
+	return n
+}
+
+type memoryNode struct {
+	id     string
+	broker *MemoryBroker
+	in     chan *Message
+	out    chan *Message
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (n *memoryNode) Publish(ctx context.Context, message *Message) error {
+	n.broker.mu.Lock()
+	peers := make([]*memoryNode, 0, len(n.broker.nodes))
+	for peer := range n.broker.nodes {
+		if peer != n {
+			peers = append(peers, peer)
+		}
+	}
+	n.broker.mu.Unlock()
+
+	for _, peer := range peers {
+		m := *message
+		m.origin = n.id
+		select {
+		case peer.in <- &m:
+		case <-peer.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (n *memoryNode) Messages() <-chan *Message {
+	return n.out
+}
+
+func (n *memoryNode) Close() error {
+	n.once.Do(func() {
+		n.broker.mu.Lock()
+		delete(n.broker.nodes, n)
+		n.broker.mu.Unlock()
+		close(n.done)
+	})
+	return nil
+}
+
+// run queues published messages until the hub reads them, so a publisher never
+// waits on a busy hub.
+func (n *memoryNode) run() {
+	var queue []*Message
+	for {
+		var out chan *Message
+		var next *Message
+		if len(queue) > 0 {
+			out, next = n.out, queue[0]
+		}
+
+		select {
+		case m := <-n.in:
+			queue = append(queue, m)
+		case out <- next:
+			queue = queue[1:]
+		case <-n.done:
+			return
+		}
+	}
+}
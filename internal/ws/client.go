@@ -1,18 +1,119 @@
 package ws
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"server/internal/domain"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Client is one connected session of a user. A user has one per device.
 type Client struct {
-	Conn     *websocket.Conn
-	Message  chan *Message
-	ID       int64 `json:"id"`
-	RoomID   int64 `json:"roomId"`
-	Username string `json:"username"`
+	Conn        *websocket.Conn
+	Message     chan *Message
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	SessionID   string    `json:"sessionId"`
+	Device      string    `json:"device"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Login session the connection was authenticated with, 0 if unknown
+	AuthSessionID int64 `json:"-"`
+
+	// Shared by the hub and the rooms
+	mu           sync.Mutex
+	rooms        map[int64]struct{} // Rooms the session was ever subscribed to
+	acked        map[int64]int64    // Highest sequence number the session has acknowledged per room
+	typingWindow time.Time          // Start of the current typing rate limit window
+	typingCount  int                // Typing frames received in the current window
+	gone         bool               // The hub let go of the session, no room may add it anymore
+	evicted      bool               // The send queue overflowed, the session is about to be disconnected
+	closed       bool               // Message is closed
+
+	// Only touched by the hub goroutine
+	status     string    // Presence chosen by the session
+	lastActive time.Time // Last heartbeat, the session becomes idle without one
+
+	// Set by the hub before it closes Message, sent to the peer in the close frame
+	closeCode int
+	closeText string
+}
+
+// NewClient creates a session whose send queue holds up to the hub's
+// Config.SendQueueSize messages.
+func (h *Hub) NewClient(conn *websocket.Conn, id int64, username string, device string) *Client {
+	return &Client{
+		Conn:        conn,
+		Message:     make(chan *Message, h.config.SendQueueSize),
+		ID:          id,
+		Username:    username,
+		SessionID:   newSessionID(),
+		Device:      device,
+		ConnectedAt: time.Now(),
+		rooms:       make(map[int64]struct{}),
+		acked:       make(map[int64]int64),
+		status:      domain.PresenceOnline,
+		lastActive:  time.Now(),
+		closeCode:   websocket.CloseNormalClosure,
+	}
+}
+
+// addRoom records that the session is about to be subscribed to the room, so that
+// disconnecting it reaches the room after the subscription. It fails once the hub
+// has let go of the session.
+func (c *Client) addRoom(roomID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gone {
+		return false
+	}
+	c.rooms[roomID] = struct{}{}
+	return true
+}
+
+// leaveAll marks the session gone and returns the rooms it may be subscribed to.
+func (c *Client) leaveAll() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gone = true
+	rooms := make([]int64, 0, len(c.rooms))
+	for roomID := range c.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	close(c.Message)
+}
+
+func (c *Client) lastAck(roomID int64) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq, ok := c.acked[roomID]
+	return seq, ok
+}
+
+func (c *Client) setAck(roomID int64, seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq > c.acked[roomID] {
+		c.acked[roomID] = seq
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
 type MessageType int
@@ -20,49 +121,105 @@ type MessageType int
 const (
     Normal MessageType = iota
     LeaveRoom
+    Ack
+    Error
+    Connected
+    TypingStart
+    TypingStop
+    ReadReceipt
+    Presence
+    MessageEdited
+    MessageDeleted
+    ReactionAdded
+    ReactionRemoved
+    ThreadUpdated
+    Mention
+    MessagePinned
+    MessageUnpinned
+    SessionsRevoked // Between instances only: close the connections of revoked login sessions
 )
 
 type Message struct {
+	ID        int64 `json:"id"`
+	Seq       int64 `json:"seq,omitempty"` // Per-room order of stored messages
 	Content  string `json:"content"`
 	RoomID   int64 `json:"roomId"`
 	Username string `json:"username"`
 	SenderID int64 `json:"senderId"`
 	Type     MessageType `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Ref      string `json:"ref,omitempty"`
+	Code     string `json:"code,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	LastReadSeq int64 `json:"lastReadSeq,omitempty"` // Set on read receipts
+	Status    string `json:"status,omitempty"` // Set on presence updates
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"` // Set on tombstones
+	Reactions []*domain.ReactionCount `json:"reactions,omitempty"` // Set on replayed messages
+	Emoji     string `json:"emoji,omitempty"` // Set on reaction events, along with the number of users left with the emoji
+	Count     int    `json:"count,omitempty"`
+	ParentID    int64      `json:"parentId,omitempty"` // Set on replies and on events about them
+	ReplyCount  int        `json:"replyCount,omitempty"` // Set on messages with replies and on thread updates
+	LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+	Mentions    []int64    `json:"mentions,omitempty"` // IDs of the users mentioned in a stored message
+	Pin         *domain.Pin `json:"pin,omitempty"` // Set on pin events
+	RevokedSessions []int64 `json:"revokedSessions,omitempty"` // Login sessions of SenderID, set on SessionsRevoked
+
+	// Set by the broker: the instance the message came from and, for messages that
+	// are not for a room, the users it is for
+	origin     string
+	recipients []int64
+	// Set on join and leave announcements, which are stored but never unread
+	announcement bool
 }
 
-func (c *Client) WriteMessage(h *Hub) {
+// WriteMessage writes the client's messages to the connection and pings it, until
+// the hub closes the channel or a write fails.
+func (c *Client) WriteMessage(hub *Hub) {
+	ticker := time.NewTicker(hub.config.PingInterval)
 	defer func() {
-		c.Conn.Close()
+		ticker.Stop()
+		c.Conn.Close() // Makes ReadMessage fail, which unregisters the client
+		for range c.Message { // Keep the hub from blocking on the dead connection until then
+		}
 	}()
 
 	for {
-		message, ok := <- c.Message
-		if message == nil {		// When Leaving room, the message is nil
-			return
-		}
-		if !ok {
-			fmt.Println("Write error", ok)
-			return
-		}
-
-		c.Conn.WriteJSON(message)
-
-		if message.Type == LeaveRoom && message.SenderID == c.ID {		// When Leaving room, close the channel and delete the client from the room
-			close(h.BroadcastMap[message.SenderID])		
-			delete(h.BroadcastMap, message.SenderID)
-			delete(h.Rooms[message.RoomID].Clients, message.SenderID)
-			delete(h.ConnectionMap, message.SenderID)
-			log.Println("Deleted client", message.SenderID, "from room", message.RoomID)
+		select {
+		case message, ok := <-c.Message:
+			c.Conn.SetWriteDeadline(time.Now().Add(hub.config.WriteWait))
+			if !ok { // The hub closes the channel once the client has been unregistered
+				c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeText))
+				return
+			}
+			if err := c.Conn.WriteJSON(message); err != nil {
+				log.Printf("could not write to session %s: %v", c.SessionID, err)
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(hub.config.WriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// ReadMessage handles the client's frames until the connection fails or stays
+// silent for longer than the pong wait, then unregisters the client.
 func (c *Client) ReadMessage(hub *Hub) {
 	defer func() {
-		hub.Unregister <- c
+		hub.Unregister(c)
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(hub.config.MaxFrameSize)
+	c.Conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
+	})
+
 	for {
 		_, m, err := c.Conn.ReadMessage()
 		if err != nil {
@@ -71,25 +228,18 @@ func (c *Client) ReadMessage(hub *Hub) {
 			}
 			break
 		}
+		c.Conn.SetReadDeadline(time.Now().Add(hub.config.PongWait))
 
-		msg := &Message{
-			Content:  string(m),
-			RoomID:   c.RoomID,
-			Username: c.Username,
-			SenderID: c.ID,
-			Type:    Normal,
+		env, perr := parseEnvelope(m)
+		if perr == nil {
+			perr = opHandlers[env.Op](hub, c, env)
 		}
-		hub.Broadcast <- msg
-	}
-}
-
-func LeaveChatroom(hub *Hub) {
-	for {
-		client, ok := <-hub.LeaveRoom
-		if !ok {
-			fmt.Println("Leave error", ok)
-			return
+		if perr != nil {
+			ref := ""
+			if env != nil {
+				ref = env.Ref
+			}
+			hub.sendTo(c, errorMessage(ref, perr))
 		}
-		hub.Unregister <- client
 	}
 }
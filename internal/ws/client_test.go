@@ -0,0 +1,47 @@
+package ws_test
+
+import (
+	"server/internal/ws"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newKeepaliveHub() *ws.Hub {
+	config := ws.DefaultConfig()
+	config.PingInterval = 50 * time.Millisecond
+	config.PongWait = 200 * time.Millisecond
+	config.WriteWait = 100 * time.Millisecond
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+	return hub
+}
+
+func TestClientSilentPeerIsUnregistered(t *testing.T) {
+	hub := newKeepaliveHub()
+	// The peer never reads after its join message, so it never answers a ping
+	conn := dialTestClient(t, hub, 1, 1)
+	require.Equal(t, "tester has joined the room", readMessage(t, conn).Content)
+
+	require.Eventually(t, func() bool {
+		return len(hub.OnlineClients(1)) == 0
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestClientAnsweringPeerStaysConnected(t *testing.T) {
+	hub := newKeepaliveHub()
+	conn := dialTestClient(t, hub, 1, 1)
+
+	// Reading answers the server's pings
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(600 * time.Millisecond) // Several pong waits
+	require.Equal(t, 1, len(hub.OnlineClients(1)))
+}
@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"log"
+	"os"
+	"server/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the timings and limits of the hub and its connections.
+type Config struct {
+	// PingInterval is how often the server pings each connection. It must be shorter than PongWait.
+	PingInterval time.Duration
+	// PongWait is how long a connection may go without sending anything, pongs included,
+	// before it is considered dead and unregistered.
+	PongWait time.Duration
+	// WriteWait is how long a single write to a connection may take.
+	WriteWait time.Duration
+	// MaxFrameSize is the largest frame a client may send, in bytes.
+	MaxFrameSize int64
+	// TypingTimeout is how long a user is shown as typing after their last typing_start.
+	TypingTimeout time.Duration
+	// IdleTimeout is how long a session may go without a heartbeat before its user shows as idle.
+	IdleTimeout time.Duration
+	// RoomIdleTimeout is how long a room without clients keeps its goroutine.
+	RoomIdleTimeout time.Duration
+	// SendQueueSize is how many messages may wait to be written to a connection.
+	SendQueueSize int
+	// QueuePolicy is what happens to a message for a connection whose send queue is full.
+	QueuePolicy QueuePolicy
+	// AllowedOrigins are the browser origins, e.g. "https://chat.example.com", allowed to open connections.
+	AllowedOrigins []string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PingInterval:    50 * time.Second,
+		PongWait:        60 * time.Second,
+		WriteWait:       10 * time.Second,
+		MaxFrameSize:    16 * 1024,
+		TypingTimeout:   TypingTimeout,
+		IdleTimeout:     IdleTimeout,
+		RoomIdleTimeout: RoomIdleTimeout,
+		SendQueueSize:   256,
+		QueuePolicy:     Coalesce,
+		AllowedOrigins:  []string{"http://localhost:3000"},
+	}
+}
+
+// ConfigFromEnv is DefaultConfig with the connection timings overridden by
+// WS_PING_INTERVAL, WS_PONG_WAIT and WS_WRITE_WAIT, e.g. "30s", and the send
+// queues by WS_SEND_QUEUE_SIZE and WS_QUEUE_POLICY (drop_oldest, disconnect or coalesce).
+// WS_ALLOWED_ORIGINS replaces the allowed origins with a comma-separated list.
+func ConfigFromEnv() Config {
+	cfg := DefaultConfig()
+	util.DurationFromEnv("WS_PING_INTERVAL", &cfg.PingInterval)
+	util.DurationFromEnv("WS_PONG_WAIT", &cfg.PongWait)
+	util.DurationFromEnv("WS_WRITE_WAIT", &cfg.WriteWait)
+	if value := os.Getenv("WS_SEND_QUEUE_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil && size > 0 {
+			cfg.SendQueueSize = size
+		} else {
+			log.Printf("invalid WS_SEND_QUEUE_SIZE %q, using %d", value, cfg.SendQueueSize)
+		}
+	}
+	if value := os.Getenv("WS_QUEUE_POLICY"); value != "" {
+		if policy, err := ParseQueuePolicy(value); err == nil {
+			cfg.QueuePolicy = policy
+		} else {
+			log.Printf("%v, using coalesce", err)
+		}
+	}
+	if value := os.Getenv("WS_ALLOWED_ORIGINS"); value != "" {
+		cfg.AllowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+			}
+		}
+	}
+	if cfg.PingInterval >= cfg.PongWait {
+		log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT, using %s", cfg.PongWait*9/10)
+		cfg.PingInterval = cfg.PongWait * 9 / 10
+	}
+	return cfg
+}
@@ -1,69 +1,534 @@
 package ws
 
 import (
+	"context"
+	"log"
+	"net/http"
+	"server/internal/domain"
+	"server/internal/port"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
 )
 
-type Room struct {
-	ID      int64             `json:"id"`
-	Name    string             `json:"name"`
-	Clients map[int64]*Client `json:"clients"`
+type ClientInfo struct {
+	ID       int64        `json:"id"`
+	Username string       `json:"username"`
+	Devices  []DeviceInfo `json:"devices"`
+}
+
+type DeviceInfo struct {
+	SessionID   string    `json:"sessionId"`
+	Device      string    `json:"device"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+// RoomJoiner decides whether a user may subscribe to a room, joining it if needed.
+// It is satisfied by port.ChatroomServicePort.
+type RoomJoiner interface {
+	JoinChatroom(ctx context.Context, req *domain.JoinLeaveChatroomReq) (*domain.JoinLeaveChatroomRes, error)
+}
+
+// subscription asks a room to add a client or remove it.
+// ref is set when it came from a client op, so the result can be acked.
+// When resume is set, messages after since are replayed before live delivery starts.
+type subscription struct {
+	client *Client
+	roomID int64
+	ref    string
+	resume bool
+	since  int64
+	// threadID is set to follow only the replies to one message of the room
+	threadID int64
+}
+
+// outbound is a message on its way to a room. sender and ref are set when the
+// message came from a client op, so the result can be reported back to it.
+type outbound struct {
+	message *Message
+	sender  *Client
+	ref     string
 }
 
+// Hub keeps track of the connected sessions and routes everything else to the
+// rooms, which each run on their own goroutine (see Room). The session and presence
+// state is only ever touched by the Run goroutine; other goroutines talk to it
+// through the methods below.
+// Room messages are shared with the hubs of other server instances through broker.
 type Hub struct {
-	Rooms         map[int64]*Room
-	Register      chan *Client
-	Unregister    chan *Client
-	Broadcast     chan *Message
-	LeaveRoom     chan *Client
-	ConnectionMap map[int64]*websocket.Conn
-	BroadcastMap  map[int64]chan *Message
+	roomsMu sync.Mutex
+	rooms   map[int64]*Room
+
+	users    map[int64]map[string]*Client // Every connected session of a user, keyed by session ID
+	queries  chan func()
+	presence chan *presenceRequest
+	evicted  chan *Client
+	messages port.MessageServicePort
+	joiner   RoomJoiner
+	broker   Broker
+
+	presenceStore PresenceStore
+	local         map[int64]*userPresence            // Status of users with sessions on this instance
+	remote        map[string]map[int64]*userPresence // Status of users on other instances, by instance
+	announced     map[int64]string                   // Last status sent to contacts on this instance
+	lastRefresh   time.Time
+
+	dropped   int64 // Counters of the queue policy, updated atomically
+	coalesced int64
+	evictions int64
+
+	config Config
 }
 
-func NewHub() *Hub {
+func NewHub(messages port.MessageServicePort, joiner RoomJoiner, presenceStore PresenceStore, broker Broker, config Config) *Hub {
 	return &Hub{
-		Rooms:         make(map[int64]*Room),
-		Register:      make(chan *Client),
-		Unregister:    make(chan *Client),
-		Broadcast:     make(chan *Message, 5),
-		LeaveRoom:     make(chan *Client),
-		ConnectionMap: make(map[int64]*websocket.Conn),
-		BroadcastMap:  make(map[int64]chan *Message),
+		rooms:    make(map[int64]*Room),
+		users:    make(map[int64]map[string]*Client),
+		queries:  make(chan func()),
+		presence: make(chan *presenceRequest),
+		evicted:  make(chan *Client),
+		messages: messages,
+		joiner:   joiner,
+		broker:   broker,
+
+		presenceStore: presenceStore,
+		local:         make(map[int64]*userPresence),
+		remote:        make(map[string]map[int64]*userPresence),
+		announced:     make(map[int64]string),
+
+		config: config,
+	}
+}
+
+// CheckOrigin accepts WebSocket handshakes from the allowed origins. Browsers
+// always send Origin, so requests without one come from other clients, which
+// cannot be made to connect with a user's cookies and are let through.
+func (h *Hub) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.config.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRoom names a room. Rooms are started on first use, so this is optional.
+func (h *Hub) AddRoom(id int64, name string) {
+	h.inRoom(id, true, func(r *Room) {
+		r.Name = name
+	})
+}
+
+// Register connects a client session to the hub. It is not subscribed to any room yet.
+// A user may have any number of sessions, one per device.
+func (h *Hub) Register(client *Client) {
+	h.query(func() {
+		h.connect(client)
+	})
+}
+
+// Unregister removes the session from every room and closes its connection once
+// the rooms are done with it. The user's other sessions are not affected.
+func (h *Hub) Unregister(client *Client) {
+	h.query(func() {
+		if h.isConnected(client) {
+			h.disconnect(client)
+			h.updatePresence(client.ID, client.Username)
+		}
+	})
+}
+
+// Subscribe starts delivering the room's messages to the client. The caller is
+// responsible for checking that the client may join the room.
+func (h *Hub) Subscribe(client *Client, roomID int64) {
+	h.subscribe(&subscription{client: client, roomID: roomID})
+}
+
+// Resume subscribes the client to the room, first replaying every stored message
+// with a sequence number greater than since.
+func (h *Hub) Resume(client *Client, roomID int64, since int64) {
+	h.subscribe(&subscription{client: client, roomID: roomID, resume: true, since: since})
+}
+
+func (h *Hub) subscribe(sub *subscription) {
+	if !sub.client.addRoom(sub.roomID) {
+		return
+	}
+	h.inRoom(sub.roomID, true, func(r *Room) {
+		if sub.threadID != 0 {
+			r.follow(sub)
+		} else {
+			r.addSubscription(sub)
+		}
+	})
+}
+
+// Unsubscribe stops delivering the room's messages to the client. The connection stays open.
+func (h *Hub) Unsubscribe(client *Client, roomID int64) {
+	h.unsubscribe(&subscription{client: client, roomID: roomID})
+}
+
+func (h *Hub) unsubscribe(sub *subscription) {
+	ok := h.inRoom(sub.roomID, false, func(r *Room) {
+		r.unsubscribe(sub)
+	})
+	if !ok && sub.ref != "" {
+		h.sendTo(sub.client, errorMessage(sub.ref, badRequest("not subscribed to room %d", sub.roomID)))
+	}
+}
+
+// LeaveRoom unsubscribes every session of the user from the room. It is used when
+// the user gives up their membership, so no device may keep receiving the room.
+func (h *Hub) LeaveRoom(roomID int64, clientID int64) {
+	h.inRoom(roomID, false, func(r *Room) {
+		r.leave(clientID)
+	})
+}
+
+func (h *Hub) Broadcast(message *Message) {
+	h.inRoom(message.RoomID, true, func(r *Room) {
+		r.route(&outbound{message: message})
+	})
+}
+
+// Read sends a read receipt to the room, e.g. after the user marked it read over REST.
+func (h *Hub) Read(receipt *domain.ReadReceipt, username string) {
+	h.event(&outbound{message: readReceiptMessage(receipt, username)})
+}
+
+// React tells the room about a reaction that was added or removed, e.g. over REST.
+func (h *Hub) React(reaction *domain.Reaction, username string) {
+	if reaction.Changed {
+		h.event(&outbound{message: reactionMessage(reaction, username)})
+	}
+}
+
+// Pin tells the room that the moderator pinned a message, e.g. over REST.
+func (h *Hub) Pin(pin *domain.Pin, moderatorID int64, username string) {
+	h.event(&outbound{message: pinMessage(pin, moderatorID, username, MessagePinned)})
+}
+
+// Unpin tells the room that the moderator unpinned a message, e.g. over REST.
+func (h *Hub) Unpin(pin *domain.Pin, moderatorID int64, username string) {
+	h.event(&outbound{message: pinMessage(pin, moderatorID, username, MessageUnpinned)})
+}
+
+// UpdateMessage tells the room that a stored message was edited or, when it has
+// DeletedAt set, deleted, e.g. after a change made over REST.
+func (h *Hub) UpdateMessage(m *domain.ChatMessage) {
+	h.event(&outbound{message: updateMessage(m)})
+}
+
+// event sends a room message that is not stored, such as a read receipt.
+func (h *Hub) event(out *outbound) {
+	h.inRoom(out.message.RoomID, true, func(r *Room) {
+		r.event(out)
+	})
+}
+
+// send broadcasts a message on behalf of a client and acks or rejects it using ref.
+func (h *Hub) send(sender *Client, ref string, message *Message) {
+	ok := h.inRoom(message.RoomID, false, func(r *Room) {
+		r.route(&outbound{message: message, sender: sender, ref: ref})
+	})
+	if !ok {
+		h.sendTo(sender, errorMessage(ref, badRequest("not subscribed to room %d", message.RoomID)))
+	}
+}
+
+// OnlineClients returns the users currently subscribed to the room, with one
+// entry per subscribed device.
+func (h *Hub) OnlineClients(roomID int64) []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	done := make(chan struct{})
+	ok := h.inRoom(roomID, false, func(r *Room) {
+		clients = r.clientInfo()
+		close(done)
+	})
+	if !ok {
+		return clients
+	}
+	<-done
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	for _, c := range clients {
+		sort.Slice(c.Devices, func(i, j int) bool { return c.Devices[i].ConnectedAt.Before(c.Devices[j].ConnectedAt) })
 	}
+	return clients
+}
+
+// query runs fn on the hub goroutine and waits for it to finish.
+func (h *Hub) query(fn func()) {
+	done := make(chan struct{})
+	h.queries <- func() {
+		fn()
+		close(done)
+	}
+	<-done
 }
 
 func (h *Hub) Run() {
+	tick := h.config.IdleTimeout / 5
+	if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case client := <-h.Register:
-			if _, ok := h.Rooms[client.RoomID]; ok {
-				room := h.Rooms[client.RoomID]
-
-				if _, ok := room.Clients[client.ID]; !ok { // if client is not in the room
-					room.Clients[client.ID] = client
-				}
-			}
-		case client := <-h.Unregister:
-			if _, ok := h.Rooms[client.RoomID]; ok {
-				if _, ok := h.Rooms[client.RoomID].Clients[client.ID]; ok {
-					if len(h.Rooms[client.RoomID].Clients) != 0 {
-						h.Broadcast <- &Message{ // Broadcast a message saying that the user has left the room
-							Content:  client.Username + " left the room",
-							RoomID:   client.RoomID,
-							Username: client.Username,
-							SenderID: client.ID,
-							Type:     LeaveRoom,
-						}
-					}
-				}
+		case req := <-h.presence:
+			h.setPresence(req)
+		case client := <-h.evicted:
+			h.disconnectSlow(client)
+		case now := <-ticker.C:
+			h.sweepPresence(now)
+		case message := <-h.broker.Messages():
+			switch message.Type {
+			case Presence:
+				h.receivePresence(message)
+			case Mention:
+				h.notify(message)
+			case SessionsRevoked:
+				h.closeSessions(message)
+			default:
+				h.inRoom(message.RoomID, false, func(r *Room) { // Nobody here is in a room that is not running
+					r.fanOut(message)
+				})
 			}
+		case fn := <-h.queries:
+			fn()
+		}
+	}
+}
+
+func (h *Hub) isConnected(client *Client) bool {
+	return h.users[client.ID][client.SessionID] == client
+}
+
+func (h *Hub) connect(client *Client) {
+	if _, ok := h.users[client.ID]; !ok {
+		h.users[client.ID] = make(map[string]*Client)
+	}
+	h.users[client.ID][client.SessionID] = client
+	h.sendTo(client, &Message{
+		Type:      Connected,
+		SenderID:  client.ID,
+		Username:  client.Username,
+		SessionID: client.SessionID,
+	})
+	h.updatePresence(client.ID, client.Username)
+}
+
+// disconnect removes the session from all of its rooms. Its message channel is
+// closed once every room has let go of it, so what they queued before is still written.
+func (h *Hub) disconnect(client *Client) {
+	if !h.isConnected(client) {
+		return
+	}
+	delete(h.users[client.ID], client.SessionID)
+	if len(h.users[client.ID]) == 0 {
+		delete(h.users, client.ID)
+	}
+
+	var wg sync.WaitGroup
+	for _, roomID := range client.leaveAll() {
+		wg.Add(1)
+		ok := h.inRoom(roomID, false, func(r *Room) {
+			r.removeSubscription(client)
+			wg.Done()
+		})
+		if !ok {
+			wg.Done()
+		}
+	}
+	go func() {
+		wg.Wait()
+		client.close()
+	}()
+}
+
+// RevokeSessions closes the user's connections, on every instance, that were
+// authenticated with one of the given login sessions.
+func (h *Hub) RevokeSessions(userID int64, sessionIDs []int64) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	message := &Message{Type: SessionsRevoked, SenderID: userID, RevokedSessions: sessionIDs}
+	h.publish(message)
+	h.query(func() {
+		h.closeSessions(message)
+	})
+}
 
-		case message := <-h.Broadcast:
-			if _, ok := h.Rooms[message.RoomID]; ok {
-				for _, cl := range h.Rooms[message.RoomID].Clients {
-					cl.Message <- message
-				}
+func (h *Hub) closeSessions(message *Message) {
+	var closed *Client
+	for _, client := range h.users[message.SenderID] {
+		for _, id := range message.RevokedSessions {
+			if client.AuthSessionID == id {
+				client.closeCode, client.closeText = websocket.ClosePolicyViolation, "session revoked"
+				h.disconnect(client)
+				closed = client
+				break
 			}
 		}
 	}
+	if closed != nil {
+		h.updatePresence(closed.ID, closed.Username)
+	}
+}
+
+// publish sends a message to the hubs of the other instances.
+func (h *Hub) publish(message *Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := h.broker.Publish(ctx, message); err != nil { // Stored messages can still be caught up on by resuming
+		log.Printf("could not publish message %d for room %d: %v", message.ID, message.RoomID, err)
+	}
+}
+
+// sendTo queues a message for one client, provided its connection is still open.
+// It is safe to call from any goroutine.
+func (h *Hub) sendTo(client *Client, message *Message) {
+	h.enqueue(client, message)
+}
+
+func (h *Hub) saveMessage(message *Message) error {
+	m, err := h.messages.SaveMessage(context.Background(), &domain.ChatMessage{
+		RoomID:   message.RoomID,
+		SenderID: message.SenderID,
+		Username: message.Username,
+		Content:  message.Content,
+		Type:     int(message.Type),
+		ParentID: message.ParentID,
+
+		Announcement: message.announcement,
+	})
+	if err != nil {
+		return err
+	}
+
+	message.ID = m.ID
+	message.Seq = m.Seq
+	message.CreatedAt = m.CreatedAt
+	message.Mentions = m.Mentions
+	return nil
+}
+
+// mention tells the users mentioned in a stored message about it on every
+// instance, whether or not they are subscribed to its room.
+func (h *Hub) mention(message *Message) {
+	notice := *message
+	notice.Type, notice.recipients = Mention, message.Mentions
+	h.publish(&notice)
+	go func() { // Rooms must not wait for the hub, which may be waiting for them
+		h.queries <- func() { h.notify(&notice) }
+	}()
+}
+
+// notify sends a message to every session of its recipients on this instance.
+func (h *Hub) notify(message *Message) {
+	for _, userID := range message.recipients {
+		for _, client := range h.users[userID] {
+			h.sendTo(client, message)
+		}
+	}
+}
+
+func readReceiptMessage(receipt *domain.ReadReceipt, username string) *Message {
+	return &Message{
+		RoomID:      receipt.RoomID,
+		SenderID:    receipt.UserID,
+		Username:    username,
+		Type:        ReadReceipt,
+		LastReadSeq: receipt.LastReadSeq,
+		CreatedAt:   receipt.ReadAt,
+	}
+}
+
+// pinMessage is the event for a pin, identified by the ID of the pinned message
+// and sent by the moderator who pinned or unpinned it.
+func pinMessage(pin *domain.Pin, moderatorID int64, username string, typ MessageType) *Message {
+	message := &Message{
+		ID:       pin.MessageID,
+		RoomID:   pin.RoomID,
+		SenderID: moderatorID,
+		Username: username,
+		Type:     typ,
+	}
+	if typ == MessagePinned {
+		message.Pin = pin
+	}
+	if pin.Message != nil {
+		message.ParentID = pin.Message.ParentID
+	}
+	return message
+}
+
+// reactionMessage is the event for a reaction, identified by the ID of the message it is on.
+func reactionMessage(reaction *domain.Reaction, username string) *Message {
+	message := &Message{
+		ID:       reaction.MessageID,
+		RoomID:   reaction.RoomID,
+		ParentID: reaction.ParentID,
+		SenderID: reaction.UserID,
+		Username: username,
+		Type:     ReactionAdded,
+		Emoji:    reaction.Emoji,
+		Count:    reaction.Count,
+	}
+	if reaction.Removed {
+		message.Type = ReactionRemoved
+	}
+	return message
+}
+
+func messageFromDomain(m *domain.ChatMessage) *Message {
+	return &Message{
+		ID:        m.ID,
+		Seq:       m.Seq,
+		Content:   m.Content,
+		RoomID:    m.RoomID,
+		Username:  m.Username,
+		SenderID:  m.SenderID,
+		Type:      MessageType(m.Type),
+		CreatedAt: m.CreatedAt,
+		EditedAt:  m.EditedAt,
+		DeletedAt: m.DeletedAt,
+		Reactions: m.Reactions,
+
+		ParentID:    m.ParentID,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+		Mentions:    m.Mentions,
+	}
+}
+
+// threadMessage tells the room that a message got a reply.
+func threadMessage(m *domain.ChatMessage) *Message {
+	return &Message{
+		ID:          m.ID,
+		RoomID:      m.RoomID,
+		Type:        ThreadUpdated,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+	}
+}
+
+// updateMessage is the event replacing a stored message on clients that already have it,
+// identified by ID. It has no seq of its own, so replay deduplication never drops it.
+func updateMessage(m *domain.ChatMessage) *Message {
+	message := messageFromDomain(m)
+	message.Seq = 0
+	message.Type = MessageEdited
+	if m.DeletedAt != nil {
+		message.Type = MessageDeleted
+	}
+	return message
 }
@@ -0,0 +1,770 @@
+package ws_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"server/internal/domain"
+	"server/internal/ws"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryMessageService struct {
+	mu         sync.Mutex
+	messages   []*domain.ChatMessage
+	lastSeq    map[int64]int64
+	reads      map[[2]int64]int64 // Keyed by user and room
+	edits      map[int64][]*domain.MessageEdit
+	moderators map[int64]bool               // Users moderating every room
+	reactions  map[int64]map[string][]int64 // Users per emoji, keyed by message ID
+	users      map[string]int64             // IDs of the users that can be mentioned, keyed by username
+	pins       map[int64][]*domain.Pin      // Keyed by room ID
+}
+
+func (s *memoryMessageService) SaveMessage(ctx context.Context, message *domain.ChatMessage) (*domain.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if message.ParentID != 0 {
+		id := message.ParentID
+		if id > int64(len(s.messages)) || s.messages[id-1].RoomID != message.RoomID || s.messages[id-1].ParentID != 0 {
+			return nil, domain.ErrMessageIDNotFound.With("message with id %d cannot be replied to in chatroom with id %d", id, message.RoomID)
+		}
+		parent := *s.messages[id-1]
+		now := time.Now()
+		parent.ReplyCount, parent.LastReplyAt = parent.ReplyCount+1, &now
+		s.messages[id-1] = &parent
+	}
+	if s.lastSeq == nil {
+		s.lastSeq = make(map[int64]int64)
+	}
+	s.lastSeq[message.RoomID]++
+	saved := *message
+	saved.ID = int64(len(s.messages) + 1)
+	saved.Seq = s.lastSeq[message.RoomID]
+	saved.CreatedAt = time.Now()
+	for _, username := range domain.ParseMentions(message.Content) {
+		if id, ok := s.users[username]; ok && id != message.SenderID {
+			saved.Mentions = append(saved.Mentions, id)
+		}
+	}
+	s.messages = append(s.messages, &saved)
+	return &saved, nil
+}
+
+func (s *memoryMessageService) GetMessagesSince(ctx context.Context, roomID int64, since int64, limit int) ([]*domain.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []*domain.ChatMessage{}
+	for _, m := range s.messages {
+		if m.RoomID == roomID && m.Seq > since && len(res) < limit {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryMessageService) GetMessage(ctx context.Context, id int64) (*domain.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > int64(len(s.messages)) {
+		return nil, domain.ErrMessageIDNotFound.With("message with id %d does not exist", id)
+	}
+	return s.messages[id-1], nil
+}
+
+func (s *memoryMessageService) MarkRead(ctx context.Context, req *domain.MarkReadReq) (*domain.ReadReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reads == nil {
+		s.reads = make(map[[2]int64]int64)
+	}
+	key := [2]int64{req.UserID, req.RoomID}
+	seq := req.Seq
+	if seq > s.lastSeq[req.RoomID] {
+		seq = s.lastSeq[req.RoomID]
+	}
+	if seq > s.reads[key] {
+		s.reads[key] = seq
+	}
+	return &domain.ReadReceipt{RoomID: req.RoomID, UserID: req.UserID, LastReadSeq: s.reads[key], ReadAt: time.Now()}, nil
+}
+
+// change applies fn to a copy of the message, so messages already handed out stay as they were.
+func (s *memoryMessageService) change(id int64, userID int64, fn func(m *domain.ChatMessage)) (*domain.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= 0 || id > int64(len(s.messages)) || s.messages[id-1].DeletedAt != nil {
+		return nil, domain.ErrMessageIDNotFound.With("message with id %d does not exist or was deleted", id)
+	}
+	changed := *s.messages[id-1]
+	if changed.SenderID != userID && !s.moderators[userID] {
+		return nil, domain.ErrNotMessageEditor.With("user with id %d may not change message with id %d", userID, id)
+	}
+	fn(&changed)
+	s.messages[id-1] = &changed
+	return &changed, nil
+}
+
+func (s *memoryMessageService) EditMessage(ctx context.Context, req *domain.EditMessageReq) (*domain.ChatMessage, error) {
+	return s.change(req.ID, req.UserID, func(m *domain.ChatMessage) {
+		if s.edits == nil {
+			s.edits = make(map[int64][]*domain.MessageEdit)
+		}
+		now := time.Now()
+		s.edits[m.ID] = append(s.edits[m.ID], &domain.MessageEdit{MessageID: m.ID, EditorID: req.UserID, Content: m.Content, EditedAt: now})
+		m.Content, m.EditedAt = req.Content, &now
+	})
+}
+
+func (s *memoryMessageService) DeleteMessage(ctx context.Context, req *domain.DeleteMessageReq) (*domain.ChatMessage, error) {
+	return s.change(req.ID, req.UserID, func(m *domain.ChatMessage) {
+		now := time.Now()
+		delete(s.edits, m.ID)
+		m.Content, m.DeletedAt = "", &now
+	})
+}
+
+func (s *memoryMessageService) GetMessageEdits(ctx context.Context, req *domain.GetMessageEditsReq) ([]*domain.MessageEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.edits[req.ID], nil
+}
+
+func (s *memoryMessageService) React(ctx context.Context, req *domain.ReactReq) (*domain.Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.MessageID <= 0 || req.MessageID > int64(len(s.messages)) || s.messages[req.MessageID-1].DeletedAt != nil {
+		return nil, domain.ErrMessageIDNotFound.With("message with id %d does not exist or was deleted", req.MessageID)
+	}
+	if s.reactions == nil {
+		s.reactions = make(map[int64]map[string][]int64)
+	}
+	if s.reactions[req.MessageID] == nil {
+		s.reactions[req.MessageID] = make(map[string][]int64)
+	}
+
+	reaction := &domain.Reaction{MessageID: req.MessageID, RoomID: s.messages[req.MessageID-1].RoomID, UserID: req.UserID, Emoji: req.Emoji, Removed: req.Remove}
+	users := s.reactions[req.MessageID][req.Emoji]
+	i := indexOf(users, req.UserID)
+	switch {
+	case req.Remove && i >= 0:
+		users = append(users[:i:i], users[i+1:]...)
+		reaction.Changed = true
+	case !req.Remove && i < 0:
+		users = append(users, req.UserID)
+		reaction.Changed = true
+	}
+	s.reactions[req.MessageID][req.Emoji] = users
+	reaction.Count = len(users)
+	return reaction, nil
+}
+
+func indexOf(ids []int64, id int64) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryMessageService) PinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.moderators[req.UserID] {
+		return nil, domain.ErrNotRoomModerator.With("user with id %d does not moderate chatroom with id %d", req.UserID, req.RoomID)
+	}
+	if req.MessageID <= 0 || req.MessageID > int64(len(s.messages)) || s.messages[req.MessageID-1].RoomID != req.RoomID {
+		return nil, domain.ErrMessageIDNotFound.With("message with id %d does not exist in chatroom with id %d", req.MessageID, req.RoomID)
+	}
+	if s.pins == nil {
+		s.pins = make(map[int64][]*domain.Pin)
+	}
+	for _, pin := range s.pins[req.RoomID] {
+		if pin.MessageID == req.MessageID {
+			return pin, nil
+		}
+	}
+	if len(s.pins[req.RoomID]) >= domain.MaxPins {
+		return nil, domain.ErrTooManyPins.With("chatroom with id %d already has %d pinned messages", req.RoomID, domain.MaxPins)
+	}
+	pin := &domain.Pin{RoomID: req.RoomID, MessageID: req.MessageID, PinnedBy: req.UserID, PinnedAt: time.Now(), Message: s.messages[req.MessageID-1]}
+	s.pins[req.RoomID] = append(s.pins[req.RoomID], pin)
+	return pin, nil
+}
+
+func (s *memoryMessageService) UnpinMessage(ctx context.Context, req *domain.PinReq) (*domain.Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.moderators[req.UserID] {
+		return nil, domain.ErrNotRoomModerator.With("user with id %d does not moderate chatroom with id %d", req.UserID, req.RoomID)
+	}
+	pins := s.pins[req.RoomID]
+	for i, pin := range pins {
+		if pin.MessageID == req.MessageID {
+			s.pins[req.RoomID] = append(pins[:i:i], pins[i+1:]...)
+			return &domain.Pin{RoomID: pin.RoomID, MessageID: pin.MessageID, PinnedBy: pin.PinnedBy, PinnedAt: pin.PinnedAt}, nil
+		}
+	}
+	return nil, domain.ErrMessageIDNotFound.With("message with id %d is not pinned in chatroom with id %d", req.MessageID, req.RoomID)
+}
+
+func (s *memoryMessageService) GetPins(ctx context.Context, req *domain.GetPinsReq) ([]*domain.Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pins[req.RoomID], nil
+}
+
+func (s *memoryMessageService) GetMessages(ctx context.Context, req *domain.GetMessagesReq) (*domain.GetMessagesRes, error) {
+	return &domain.GetMessagesRes{}, nil
+}
+
+func (s *memoryMessageService) GetThread(ctx context.Context, req *domain.GetThreadReq) (*domain.GetThreadRes, error) {
+	return &domain.GetThreadRes{}, nil
+}
+
+func (s *memoryMessageService) GetMentions(ctx context.Context, req *domain.GetMentionsReq) (*domain.GetMentionsRes, error) {
+	return &domain.GetMentionsRes{}, nil
+}
+
+func (s *memoryMessageService) SearchMessages(ctx context.Context, req *domain.SearchMessagesReq) (*domain.SearchMessagesRes, error) {
+	return &domain.SearchMessagesRes{}, nil
+}
+
+// memoryJoiner lets every user join every room except the ones in forbidden.
+type memoryJoiner struct {
+	forbidden map[int64]bool
+}
+
+func (j *memoryJoiner) JoinChatroom(ctx context.Context, req *domain.JoinLeaveChatroomReq) (*domain.JoinLeaveChatroomRes, error) {
+	if j.forbidden[req.ID] {
+		return nil, domain.ErrChatroomFull.With("chatroom with id %d is full", req.ID)
+	}
+	return &domain.JoinLeaveChatroomRes{ID: req.ID}, nil
+}
+
+// memoryPresenceStore tells nobody about a user's presence unless contacts says otherwise.
+type memoryPresenceStore struct {
+	mu       sync.Mutex
+	contacts map[int64][]int64
+	lastSeen map[int64]time.Time
+}
+
+func (s *memoryPresenceStore) GetContacts(ctx context.Context, userID int64) ([]int64, error) {
+	return s.contacts[userID], nil
+}
+
+func (s *memoryPresenceStore) UpdateLastSeen(ctx context.Context, userID int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastSeen == nil {
+		s.lastSeen = make(map[int64]time.Time)
+	}
+	s.lastSeen[userID] = at
+	return nil
+}
+
+func (s *memoryPresenceStore) GetLastSeen(ctx context.Context, userID int64) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastSeen, ok := s.lastSeen[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &lastSeen, nil
+}
+
+func newTestHub() *ws.Hub {
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+	return hub
+}
+
+// newTestClient registers a client whose messages are collected instead of being
+// written to a connection. received yields them once the hub lets go of the client.
+func newTestClient(hub *ws.Hub, id int64, rooms ...int64) (*ws.Client, <-chan []*ws.Message) {
+	client := hub.NewClient(nil, id, fmt.Sprintf("user%d", id), "test")
+	received := make(chan []*ws.Message, 1)
+	go func() {
+		var messages []*ws.Message
+		for m := range client.Message {
+			messages = append(messages, m)
+		}
+		received <- messages
+	}()
+
+	hub.Register(client)
+	for _, roomID := range rooms {
+		hub.Subscribe(client, roomID)
+	}
+	return client, received
+}
+
+func userIDs(clients []ws.ClientInfo) []int64 {
+	ids := []int64{}
+	for _, c := range clients {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func contents(messages []*ws.Message, roomID int64, typ ws.MessageType) []string {
+	var res []string
+	for _, m := range messages {
+		if m.RoomID == roomID && m.Type == typ {
+			res = append(res, m.Content)
+		}
+	}
+	return res
+}
+
+func TestHubBroadcastReachesRoomOnly(t *testing.T) {
+	hub := newTestHub()
+
+	client1, received1 := newTestClient(hub, 1, 1)
+	client2, received2 := newTestClient(hub, 2, 2)
+
+	hub.Broadcast(&ws.Message{Content: "hello", RoomID: 1, SenderID: 1, Type: ws.Normal})
+	require.Equal(t, 1, len(hub.OnlineClients(1)))
+
+	hub.Unregister(client1)
+	hub.Unregister(client2)
+
+	messages1 := <-received1
+	require.Equal(t, []string{"user1 has joined the room", "hello"}, contents(messages1, 1, ws.Normal))
+	require.NotZero(t, messages1[1].ID)
+	require.Empty(t, contents(<-received2, 1, ws.Normal))
+}
+
+func TestHubStoresAnnouncements(t *testing.T) {
+	messages := &memoryMessageService{}
+	hub := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+
+	client1, received1 := newTestClient(hub, 1, 1)
+	client2, _ := newTestClient(hub, 2, 1)
+	hub.Broadcast(&ws.Message{Content: "hello", RoomID: 1, SenderID: 1, Type: ws.Normal})
+	hub.Unregister(client2)
+	hub.Unregister(client1)
+
+	// Clients see announcements as before, only the stored messages are flagged
+	received := <-received1
+	require.Equal(t, []string{"user1 has joined the room", "user2 has joined the room", "hello"}, contents(received, 1, ws.Normal))
+	require.Equal(t, []string{"user2 left the room"}, contents(received, 1, ws.LeaveRoom))
+
+	messages.mu.Lock()
+	defer messages.mu.Unlock()
+	announcements := make(map[string]bool)
+	for _, m := range messages.messages {
+		announcements[m.Content] = m.Announcement
+	}
+	require.Equal(t, map[string]bool{
+		"user1 has joined the room": true,
+		"user2 has joined the room": true,
+		"hello":                     false,
+		"user2 left the room":       true,
+	}, announcements)
+}
+
+func TestHubOneConnectionManyRooms(t *testing.T) {
+	hub := newTestHub()
+
+	client1, received1 := newTestClient(hub, 1, 1, 2)
+	client2, received2 := newTestClient(hub, 2, 2)
+
+	hub.Broadcast(&ws.Message{Content: "to room 1", RoomID: 1, SenderID: 2, Type: ws.Normal})
+	hub.Broadcast(&ws.Message{Content: "to room 2", RoomID: 2, SenderID: 2, Type: ws.Normal})
+
+	hub.Unsubscribe(client1, 1)
+	hub.Broadcast(&ws.Message{Content: "after unsubscribe", RoomID: 1, SenderID: 2, Type: ws.Normal})
+	hub.Broadcast(&ws.Message{Content: "still here", RoomID: 2, SenderID: 2, Type: ws.Normal})
+	require.Equal(t, 0, len(hub.OnlineClients(1)))
+	require.Equal(t, 2, len(hub.OnlineClients(2)))
+
+	hub.Unregister(client1)
+	hub.Unregister(client2)
+
+	messages1 := <-received1
+	require.Equal(t, []string{"user1 has joined the room", "to room 1"}, contents(messages1, 1, ws.Normal))
+	require.Equal(t, []string{"user1 has joined the room", "user2 has joined the room", "to room 2", "still here"}, contents(messages1, 2, ws.Normal))
+
+	messages2 := <-received2
+	require.Equal(t, []string{"user1 left the room"}, contents(messages2, 2, ws.LeaveRoom))
+}
+
+func TestHubLeaveRoomKeepsConnection(t *testing.T) {
+	hub := newTestHub()
+
+	client1, received1 := newTestClient(hub, 1, 1, 2)
+	client2, received2 := newTestClient(hub, 2, 1)
+
+	hub.LeaveRoom(1, 1)
+	require.Equal(t, []int64{2}, userIDs(hub.OnlineClients(1)))
+	require.Equal(t, []int64{1}, userIDs(hub.OnlineClients(2)))
+
+	hub.Broadcast(&ws.Message{Content: "hello", RoomID: 2, SenderID: 1, Type: ws.Normal})
+
+	hub.Unregister(client1)
+	// Unregistering twice must not close the channel twice
+	hub.Unregister(client1)
+	hub.Unregister(client2)
+
+	require.Equal(t, []string{"user1 has joined the room", "hello"}, contents(<-received1, 2, ws.Normal))
+	require.Equal(t, []string{"user1 left the room"}, contents(<-received2, 1, ws.LeaveRoom))
+}
+
+func TestHubMultipleDevices(t *testing.T) {
+	hub := newTestHub()
+
+	phone, receivedPhone := newTestClient(hub, 1, 1)
+	laptop, receivedLaptop := newTestClient(hub, 1, 1)
+	other, receivedOther := newTestClient(hub, 2, 1)
+
+	online := hub.OnlineClients(1)
+	require.Equal(t, []int64{1, 2}, userIDs(online))
+	require.Equal(t, 2, len(online[0].Devices))
+	require.Equal(t, phone.SessionID, online[0].Devices[0].SessionID)
+	require.Equal(t, laptop.SessionID, online[0].Devices[1].SessionID)
+
+	hub.Broadcast(&ws.Message{Content: "to both devices", RoomID: 1, SenderID: 2, Type: ws.Normal})
+
+	// Disconnecting the phone leaves the laptop subscribed
+	hub.Unregister(phone)
+	online = hub.OnlineClients(1)
+	require.Equal(t, []int64{1, 2}, userIDs(online))
+	require.Equal(t, 1, len(online[0].Devices))
+	hub.Broadcast(&ws.Message{Content: "laptop only", RoomID: 1, SenderID: 2, Type: ws.Normal})
+
+	// Unsubscribing the laptop is the user's last device leaving the room
+	hub.Unsubscribe(laptop, 1)
+	require.Equal(t, []int64{2}, userIDs(hub.OnlineClients(1)))
+
+	hub.Unregister(laptop)
+	hub.Unregister(other)
+
+	require.Equal(t, []string{"user1 has joined the room", "user2 has joined the room", "to both devices"}, contents(<-receivedPhone, 1, ws.Normal))
+	// The laptop joining is not announced again, the user was already in the room
+	require.Equal(t, []string{"user2 has joined the room", "to both devices", "laptop only"}, contents(<-receivedLaptop, 1, ws.Normal))
+	messagesOther := <-receivedOther
+	require.Equal(t, []string{"user2 has joined the room", "to both devices", "laptop only"}, contents(messagesOther, 1, ws.Normal))
+	require.Equal(t, []string{"user1 left the room"}, contents(messagesOther, 1, ws.LeaveRoom))
+}
+
+func TestHubConnectedMessage(t *testing.T) {
+	hub := newTestHub()
+
+	client, received := newTestClient(hub, 1)
+	hub.Unregister(client)
+
+	messages := <-received
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, ws.Connected, messages[0].Type)
+	require.Equal(t, client.SessionID, messages[0].SessionID)
+}
+
+func TestHubConcurrentAccess(t *testing.T) {
+	const rooms = 8
+	const clientsPerRoom = 16
+	const messagesPerClient = 20
+
+	hub := newTestHub()
+	var wg sync.WaitGroup
+
+	for r := int64(1); r <= rooms; r++ {
+		wg.Add(1)
+		go func(roomID int64) {
+			defer wg.Done()
+			hub.AddRoom(roomID, fmt.Sprintf("room%d", roomID))
+		}(r)
+	}
+	wg.Wait()
+
+	for r := int64(1); r <= rooms; r++ {
+		for i := int64(0); i < clientsPerRoom; i++ {
+			wg.Add(1)
+			go func(roomID, id int64) {
+				defer wg.Done()
+				otherRoom := roomID%rooms + 1
+				client, received := newTestClient(hub, id, roomID, otherRoom)
+				for m := 0; m < messagesPerClient; m++ {
+					hub.Broadcast(&ws.Message{
+						Content:  "hi",
+						RoomID:   roomID,
+						SenderID: id,
+						Type:     ws.Normal,
+					})
+					hub.OnlineClients(roomID)
+				}
+				if id%2 == 0 {
+					hub.LeaveRoom(roomID, id)
+				} else {
+					hub.Unsubscribe(client, otherRoom)
+				}
+				hub.Unregister(client)
+				<-received
+			}(r, r*100+i)
+		}
+	}
+	wg.Wait()
+
+	for r := int64(1); r <= rooms; r++ {
+		require.Equal(t, 0, len(hub.OnlineClients(r)))
+	}
+}
+
+func seqs(messages []*ws.Message, roomID int64) []int64 {
+	var res []int64
+	for _, m := range messages {
+		if m.RoomID == roomID && m.Seq != 0 {
+			res = append(res, m.Seq)
+		}
+	}
+	return res
+}
+
+func TestHubResumeReplaysMissedMessages(t *testing.T) {
+	hub := newTestHub()
+
+	sender, receivedSender := newTestClient(hub, 1, 1)
+	for i := 0; i < 3; i++ {
+		hub.Broadcast(&ws.Message{Content: fmt.Sprintf("missed %d", i), RoomID: 1, SenderID: 1, Type: ws.Normal})
+	}
+
+	// The reconnecting client saw up to seq 2 (the join message and "missed 0")
+	client := hub.NewClient(nil, 2, "user2", "test")
+	received := make(chan []*ws.Message, 1)
+	go func() {
+		var messages []*ws.Message
+		for m := range client.Message {
+			messages = append(messages, m)
+		}
+		received <- messages
+	}()
+	hub.Register(client)
+	hub.Resume(client, 1, 2)
+	hub.Broadcast(&ws.Message{Content: "live", RoomID: 1, SenderID: 1, Type: ws.Normal})
+
+	hub.Unregister(client)
+	hub.Unregister(sender)
+	<-receivedSender
+
+	messages := <-received
+	require.Equal(t, []int64{3, 4, 5, 6}, seqs(messages, 1))
+	require.Equal(t, []string{"missed 1", "missed 2", "user2 has joined the room", "live"}, contents(messages, 1, ws.Normal))
+}
+
+// streamClient registers a client whose messages can be awaited as they arrive.
+func streamClient(hub *ws.Hub, id int64, roomID int64) (*ws.Client, <-chan *ws.Message) {
+	client := hub.NewClient(nil, id, fmt.Sprintf("user%d", id), "test")
+	stream := make(chan *ws.Message, 100)
+	go func() {
+		for m := range client.Message {
+			stream <- m
+		}
+	}()
+	hub.Register(client)
+	hub.Subscribe(client, roomID)
+	return client, stream
+}
+
+// awaitContents reads messages in the room from stream until all of want have arrived.
+func awaitContents(t *testing.T, stream <-chan *ws.Message, roomID int64, want ...string) {
+	pending := make(map[string]bool)
+	for _, w := range want {
+		pending[w] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(pending) > 0 {
+		select {
+		case m := <-stream:
+			if m.RoomID == roomID {
+				delete(pending, m.Content)
+			}
+		case <-timeout:
+			t.Fatalf("messages not received: %v", pending)
+		}
+	}
+}
+
+func TestHubBrokerSharesRoomsAcrossNodes(t *testing.T) {
+	messages := &memoryMessageService{}
+	broker := ws.NewMemoryBroker()
+	hub1 := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, broker.Node(), ws.DefaultConfig())
+	hub2 := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, broker.Node(), ws.DefaultConfig())
+	go hub1.Run()
+	go hub2.Run()
+
+	_, stream1 := streamClient(hub1, 1, 1)
+	_, stream2 := streamClient(hub2, 2, 1)
+	awaitContents(t, stream1, 1, "user1 has joined the room", "user2 has joined the room")
+
+	hub1.Broadcast(&ws.Message{Content: "from node 1", RoomID: 1, SenderID: 1, Type: ws.Normal})
+	hub2.Broadcast(&ws.Message{Content: "from node 2", RoomID: 1, SenderID: 2, Type: ws.Normal})
+	awaitContents(t, stream1, 1, "from node 1", "from node 2")
+	awaitContents(t, stream2, 1, "user2 has joined the room", "from node 1", "from node 2")
+
+	// Each node only lists its own clients
+	require.Equal(t, []int64{1}, userIDs(hub1.OnlineClients(1)))
+	require.Equal(t, []int64{2}, userIDs(hub2.OnlineClients(1)))
+}
+
+// awaitPresence reads from stream until a presence update for the user arrives and returns it.
+func awaitPresence(t *testing.T, stream <-chan *ws.Message, userID int64) *ws.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-stream:
+			if m.Type == ws.Presence && m.SenderID == userID {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no presence update for user %d", userID)
+		}
+	}
+}
+
+func TestHubPresence(t *testing.T) {
+	store := &memoryPresenceStore{contacts: map[int64][]int64{1: {1, 2}, 2: {1, 2}}}
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, store, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+
+	_, stream2 := streamClient(hub, 2, 1)
+	require.Equal(t, domain.PresenceOnline, awaitPresence(t, stream2, 2).Status)
+
+	phone, _ := streamClient(hub, 1, 1)
+	require.Equal(t, domain.PresenceOnline, awaitPresence(t, stream2, 1).Status)
+	laptop, _ := streamClient(hub, 1, 1)
+
+	presence, err := hub.Presence(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.PresenceOnline, presence.Status)
+	require.Nil(t, presence.LastSeen)
+
+	// The user stays online until their last device disconnects
+	hub.Unregister(phone)
+	hub.Unregister(laptop)
+	offline := awaitPresence(t, stream2, 1)
+	require.Equal(t, domain.PresenceOffline, offline.Status)
+	require.NotNil(t, offline.LastSeen)
+
+	presence, err = hub.Presence(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.PresenceOffline, presence.Status)
+	require.NotNil(t, presence.LastSeen)
+}
+
+func TestHubPresenceIdle(t *testing.T) {
+	store := &memoryPresenceStore{contacts: map[int64][]int64{1: {2}}}
+	config := ws.DefaultConfig()
+	config.IdleTimeout = 100 * time.Millisecond
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, store, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+
+	_, stream2 := streamClient(hub, 2, 1)
+	streamClient(hub, 1, 1)
+	require.Equal(t, domain.PresenceOnline, awaitPresence(t, stream2, 1).Status)
+	require.Equal(t, domain.PresenceIdle, awaitPresence(t, stream2, 1).Status)
+}
+
+func TestHubPresenceAcrossNodes(t *testing.T) {
+	store := &memoryPresenceStore{contacts: map[int64][]int64{1: {1, 2}}}
+	broker := ws.NewMemoryBroker()
+	hub1 := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, store, broker.Node(), ws.DefaultConfig())
+	hub2 := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, store, broker.Node(), ws.DefaultConfig())
+	go hub1.Run()
+	go hub2.Run()
+
+	_, stream2 := streamClient(hub2, 2, 1)
+	client1, _ := streamClient(hub1, 1, 1)
+	require.Equal(t, domain.PresenceOnline, awaitPresence(t, stream2, 1).Status)
+
+	presence, err := hub2.Presence(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.PresenceOnline, presence.Status)
+
+	hub1.Unregister(client1)
+	require.Equal(t, domain.PresenceOffline, awaitPresence(t, stream2, 1).Status)
+}
+
+func TestHubRevokeSessionsClosesConnectionsOnEveryNode(t *testing.T) {
+	messages := &memoryMessageService{}
+	broker := ws.NewMemoryBroker()
+	hub1 := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, broker.Node(), ws.DefaultConfig())
+	hub2 := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, broker.Node(), ws.DefaultConfig())
+	go hub1.Run()
+	go hub2.Run()
+
+	// connect registers a client of user 1 that logged in with the given session
+	connect := func(hub *ws.Hub, authSessionID int64) (*ws.Client, <-chan struct{}) {
+		client := hub.NewClient(nil, 1, "user1", "test")
+		client.AuthSessionID = authSessionID
+		closed := make(chan struct{})
+		go func() {
+			for range client.Message {
+			}
+			close(closed)
+		}()
+		hub.Register(client)
+		hub.Subscribe(client, 1)
+		return client, closed
+	}
+	_, phoneClosed := connect(hub1, 10)
+	laptop, laptopClosed := connect(hub2, 11)
+	_, tabletClosed := connect(hub2, 10)
+
+	hub1.RevokeSessions(1, []int64{10})
+	for _, closed := range []<-chan struct{}{phoneClosed, tabletClosed} {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection of a revoked session is still open")
+		}
+	}
+
+	// Connections of other sessions stay open
+	require.Empty(t, hub1.OnlineClients(1))
+	online := hub2.OnlineClients(1)
+	require.Equal(t, []int64{1}, userIDs(online))
+	require.Len(t, online[0].Devices, 1)
+	require.Equal(t, laptop.SessionID, online[0].Devices[0].SessionID)
+	select {
+	case <-laptopClosed:
+		t.Fatal("connection of another session was closed")
+	default:
+	}
+}
+
+func TestHubCheckOrigin(t *testing.T) {
+	config := ws.DefaultConfig()
+	config.AllowedOrigins = []string{"https://chat.example.com"}
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+
+	for origin, allowed := range map[string]bool{
+		"https://chat.example.com":      true,
+		"":                              true,
+		"https://evil.example.com":      false,
+		"http://chat.example.com":       false,
+		"https://chat.example.com.evil": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ws/connect", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		require.Equal(t, allowed, hub.CheckOrigin(r), origin)
+	}
+}
@@ -0,0 +1,203 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"server/internal/port"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pgChannel = "chat_room_messages"
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more
+	pgMaxPayload   = 7900
+	pgPingInterval = 90 * time.Second
+)
+
+// pgNotification is the payload of a NOTIFY. Messages too large to fit are sent
+// by ID only and loaded from the database by the receiving instances; pin events
+// are sent without the pinned message, which the receiving instances load.
+type pgNotification struct {
+	Node       string      `json:"node"`
+	Message    *Message    `json:"message,omitempty"`
+	ID         int64       `json:"id,omitempty"`
+	Type       MessageType `json:"type,omitempty"` // Type of a message sent by ID, when it is an update
+	Recipients []int64     `json:"recipients,omitempty"`
+}
+
+// PostgresBroker shares room messages between server instances connected to the
+// same database using LISTEN/NOTIFY. Notifications sent while an instance is
+// reconnecting to the database are lost; its clients catch up by resuming.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	messages port.MessageServicePort
+	node     string
+	out      chan *Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewPostgresBroker(connStr string, db *sql.DB, messages port.MessageServicePort) (*PostgresBroker, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("broker lost its database connection: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Println("broker reconnected to the database, notifications sent meanwhile were missed")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("broker could not reconnect to the database: %v", err)
+		}
+	})
+	if err := listener.Listen(pgChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBroker{
+		db:       db,
+		listener: listener,
+		messages: messages,
+		node:     newSessionID(),
+		out:      make(chan *Message),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, message *Message) error {
+	payload, err := encodeNotification(&pgNotification{Node: b.node, Message: message, Recipients: message.recipients})
+	if err != nil {
+		return err
+	}
+	if len(payload) > pgMaxPayload && message.Type == MessagePinned && message.Pin != nil {
+		event, pin := *message, *message.Pin
+		pin.Message = nil
+		event.Pin = &pin
+		payload, err = encodeNotification(&pgNotification{Node: b.node, Message: &event, Recipients: message.recipients})
+		if err != nil {
+			return err
+		}
+	}
+	if len(payload) > pgMaxPayload {
+		// Only stored messages and updates of them can be rebuilt from the ID
+		switch {
+		case message.ID == 0:
+			return fmt.Errorf("message for room %d is too large to publish", message.RoomID)
+		case message.Type != Normal && message.Type != LeaveRoom && message.Type != MessageEdited &&
+			message.Type != MessageDeleted && message.Type != Mention:
+			return fmt.Errorf("event %d for room %d is too large to publish", message.Type, message.RoomID)
+		}
+		n := &pgNotification{Node: b.node, ID: message.ID, Recipients: message.recipients}
+		if message.Type == MessageEdited || message.Type == MessageDeleted || message.Type == Mention {
+			n.Type = message.Type
+		}
+		payload, err = encodeNotification(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", pgChannel, payload)
+	return err
+}
+
+func (b *PostgresBroker) Messages() <-chan *Message {
+	return b.out
+}
+
+func (b *PostgresBroker) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+	})
+	return err
+}
+
+func (b *PostgresBroker) run() {
+	for {
+		select {
+		case n := <-b.listener.Notify:
+			if n == nil { // Sent after a reconnect
+				continue
+			}
+			message, err := b.decode(n.Extra)
+			if err != nil {
+				log.Printf("could not read broker notification: %v", err)
+				continue
+			}
+			if message == nil {
+				continue
+			}
+			select {
+			case b.out <- message:
+			case <-b.done:
+				return
+			}
+		case <-time.After(pgPingInterval):
+			go b.listener.Ping()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// decode returns the message of a notification, or nil if this instance sent it.
+func (b *PostgresBroker) decode(payload string) (*Message, error) {
+	var n pgNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return nil, err
+	}
+	if n.Node == b.node {
+		return nil, nil
+	}
+
+	message := n.Message
+	if message != nil && message.Type == MessagePinned && message.Pin != nil && message.Pin.Message == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		m, err := b.messages.GetMessage(ctx, message.Pin.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		message.Pin.Message = m
+	}
+	if message == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		m, err := b.messages.GetMessage(ctx, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		message = messageFromDomain(m)
+		switch n.Type {
+		case MessageEdited, MessageDeleted:
+			message = updateMessage(m)
+		case Mention:
+			message.Type = Mention
+		}
+	}
+	message.origin, message.recipients = n.Node, n.Recipients
+	return message, nil
+}
+
+// encodeNotification leaves HTML characters unescaped so content does not grow
+// towards the payload limit.
+func encodeNotification(n *pgNotification) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(n); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(buf.Bytes())), nil
+}
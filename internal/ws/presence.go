@@ -0,0 +1,283 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"server/internal/domain"
+	"time"
+)
+
+const (
+	// IdleTimeout is the default Config.IdleTimeout.
+	IdleTimeout = 5 * time.Minute
+	// presenceRefresh is how often a hub republishes the presence of its users to the other
+	// instances. Their entries expire after presenceTTL without a refresh, e.g. when an instance dies.
+	presenceRefresh = 30 * time.Second
+	presenceTTL     = 3 * presenceRefresh
+)
+
+// PresenceStore records when users were last seen and who hears about their presence.
+// It is satisfied by port.PresenceServicePort.
+type PresenceStore interface {
+	GetContacts(ctx context.Context, userID int64) ([]int64, error)
+	UpdateLastSeen(ctx context.Context, userID int64, at time.Time) error
+	GetLastSeen(ctx context.Context, userID int64) (*time.Time, error)
+}
+
+// presenceRequest sets the status a session chose. An empty status is a heartbeat.
+type presenceRequest struct {
+	client *Client
+	status string
+	ref    string
+}
+
+// userPresence is a user's status on one instance, with the contacts to tell about it.
+// expires is only set for the entries of other instances, whose contacts are loaded
+// when they are first announced.
+type userPresence struct {
+	status   string
+	username string
+	contacts []int64
+	expires  time.Time
+}
+
+// presenceRank orders statuses for a user connected in several places: the highest wins.
+var presenceRank = map[string]int{
+	domain.PresenceOffline: 0,
+	domain.PresenceIdle:    1,
+	domain.PresenceOnline:  2,
+	domain.PresenceDND:     3,
+}
+
+func combinePresence(a, b string) string {
+	if presenceRank[b] > presenceRank[a] {
+		return b
+	}
+	return a
+}
+
+// Presence returns the user's status across every instance.
+func (h *Hub) Presence(ctx context.Context, userID int64) (*domain.Presence, error) {
+	var status string
+	h.query(func() {
+		status = h.globalStatus(userID, time.Now())
+	})
+
+	p := &domain.Presence{UserID: userID, Status: status}
+	if status == domain.PresenceOffline {
+		lastSeen, err := h.presenceStore.GetLastSeen(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		p.LastSeen = lastSeen
+	}
+	return p, nil
+}
+
+// presenceStatus is the status the session contributes to its user's.
+func (c *Client) presenceStatus(now time.Time, idleTimeout time.Duration) string {
+	if c.status != domain.PresenceOnline {
+		return c.status
+	}
+	if now.Sub(c.lastActive) >= idleTimeout {
+		return domain.PresenceIdle
+	}
+	return domain.PresenceOnline
+}
+
+func (h *Hub) localStatus(userID int64, now time.Time) string {
+	status := domain.PresenceOffline
+	for _, c := range h.users[userID] {
+		status = combinePresence(status, c.presenceStatus(now, h.config.IdleTimeout))
+	}
+	return status
+}
+
+func (h *Hub) globalStatus(userID int64, now time.Time) string {
+	status := h.localStatus(userID, now)
+	for _, users := range h.remote {
+		if p, ok := users[userID]; ok {
+			status = combinePresence(status, p.status)
+		}
+	}
+	return status
+}
+
+func (h *Hub) setPresence(req *presenceRequest) {
+	client := req.client
+	if !h.isConnected(client) {
+		return
+	}
+	if req.status != "" {
+		client.status = req.status
+	}
+	client.lastActive = time.Now()
+	h.updatePresence(client.ID, client.Username)
+
+	if req.ref != "" {
+		h.sendTo(client, &Message{Type: Ack, Ref: req.ref, Status: client.status})
+	}
+}
+
+// updatePresence recomputes the user's status on this instance after one of their
+// sessions changed. A change is published to the other instances and announced to
+// the user's contacts, which are reloaded in case they changed. Going offline is
+// announced once the last seen time is saved, for the contacts to read it.
+func (h *Hub) updatePresence(userID int64, username string) {
+	now := time.Now()
+	status := h.localStatus(userID, now)
+	prev, ok := h.local[userID]
+	if (ok && prev.status == status) || (!ok && status == domain.PresenceOffline) {
+		return
+	}
+
+	p := &userPresence{status: status, username: username}
+	if status == domain.PresenceOffline {
+		delete(h.local, userID)
+	} else {
+		h.local[userID] = p
+	}
+	h.publishPresence(userID, p)
+	if status != domain.PresenceOffline {
+		h.announcePresence(userID, p, now)
+		return
+	}
+	go func() { // The hub must not wait for the store
+		h.saveLastSeen(userID, now)
+		h.queries <- func() { h.announcePresence(userID, p, now) }
+	}()
+}
+
+// publishPresence sends the user's status on this instance to the others. Contacts are
+// left out, a user can have too many to fit in a notification.
+func (h *Hub) publishPresence(userID int64, p *userPresence) {
+	h.publish(&Message{
+		SenderID: userID,
+		Username: p.username,
+		Type:     Presence,
+		Status:   p.status,
+	})
+}
+
+func (h *Hub) saveLastSeen(userID int64, at time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := h.presenceStore.UpdateLastSeen(ctx, userID, at); err != nil {
+		log.Printf("could not update last seen of user %d: %v", userID, err)
+	}
+}
+
+// loadContacts loads the contacts of p's user off the hub goroutine, then announces
+// the user's status to them on the hub goroutine.
+func (h *Hub) loadContacts(userID int64, p *userPresence, now time.Time) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		contacts, err := h.presenceStore.GetContacts(ctx, userID)
+		if err != nil {
+			log.Printf("could not load contacts of user %d: %v", userID, err)
+			contacts = []int64{userID}
+		}
+		if contacts == nil {
+			contacts = []int64{}
+		}
+		h.queries <- func() {
+			p.contacts = contacts
+			h.announcePresence(userID, p, now)
+		}
+	}()
+}
+
+// receivePresence records the status of a user on another instance.
+func (h *Hub) receivePresence(message *Message) {
+	now := time.Now()
+	users, ok := h.remote[message.origin]
+	if !ok {
+		users = make(map[int64]*userPresence)
+		h.remote[message.origin] = users
+	}
+
+	p := &userPresence{
+		status:   message.Status,
+		username: message.Username,
+		expires:  now.Add(presenceTTL),
+	}
+	if prev, ok := users[message.SenderID]; ok {
+		p.contacts = prev.contacts // Refreshes keep the contacts already loaded
+	} else if local, ok := h.local[message.SenderID]; ok {
+		p.contacts = local.contacts
+	}
+	if p.status == domain.PresenceOffline {
+		delete(users, message.SenderID)
+	} else {
+		users[message.SenderID] = p
+	}
+	h.announcePresence(message.SenderID, p, now)
+}
+
+// announcePresence tells the user's contacts connected to this instance about the
+// user's status across every instance, if it changed since it was last announced.
+// Without the contacts, it waits for loadContacts, and then announces the status
+// the user has by then.
+func (h *Hub) announcePresence(userID int64, p *userPresence, now time.Time) {
+	if p.contacts == nil {
+		h.loadContacts(userID, p, now)
+		return
+	}
+	status := h.globalStatus(userID, now)
+	prev, ok := h.announced[userID]
+	if !ok {
+		prev = domain.PresenceOffline
+	}
+	if prev == status {
+		return
+	}
+	if status == domain.PresenceOffline {
+		delete(h.announced, userID)
+	} else {
+		h.announced[userID] = status
+	}
+
+	message := &Message{
+		SenderID:  userID,
+		Username:  p.username,
+		Type:      Presence,
+		Status:    status,
+		CreatedAt: now,
+	}
+	if status == domain.PresenceOffline {
+		message.LastSeen = &now
+	}
+	for _, id := range p.contacts {
+		for _, c := range h.users[id] {
+			h.sendTo(c, message)
+		}
+	}
+}
+
+// sweepPresence turns sessions without a recent heartbeat idle, drops the entries of
+// instances that stopped refreshing them and periodically refreshes our own.
+func (h *Hub) sweepPresence(now time.Time) {
+	for userID, p := range h.local {
+		h.updatePresence(userID, p.username)
+	}
+
+	for origin, users := range h.remote {
+		for userID, p := range users {
+			if now.After(p.expires) {
+				delete(users, userID)
+				h.announcePresence(userID, p, now)
+			}
+		}
+		if len(users) == 0 {
+			delete(h.remote, origin)
+		}
+	}
+
+	if now.Sub(h.lastRefresh) >= presenceRefresh {
+		h.lastRefresh = now
+		for userID, p := range h.local {
+			h.publishPresence(userID, p)
+		}
+	}
+}
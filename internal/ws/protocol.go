@@ -0,0 +1,465 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"server/internal/domain"
+	"strings"
+)
+
+const (
+	OpSend        = "send"
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpAck         = "ack"
+	OpTypingStart = "typing_start"
+	OpTypingStop  = "typing_stop"
+	OpRead        = "read"
+	OpHeartbeat   = "heartbeat"
+	OpPresence    = "presence"
+	OpEdit        = "message_edit"
+	OpDelete      = "message_delete"
+	OpReactAdd    = "reaction_add"
+	OpReactRemove = "reaction_remove"
+	OpPin         = "message_pin"
+	OpUnpin       = "message_unpin"
+)
+
+const MaxContentLength = 4000
+
+const (
+	CodeBadRequest  = "bad_request"
+	CodeUnknownOp   = "unknown_op"
+	CodeForbidden   = "forbidden"
+	CodeResumeGap   = "resume_gap"
+	CodeRateLimited = "rate_limited"
+	CodeInternal    = "internal"
+)
+
+// Envelope is the shape of every frame a client sends.
+// Ref is chosen by the client and echoed back on the matching ack or error.
+type Envelope struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+	Ref  string          `json:"ref,omitempty"`
+}
+
+// SendData posts to the room, or replies to the message with ID ParentID when it is set.
+type SendData struct {
+	RoomID   int64  `json:"roomId"`
+	Content  string `json:"content"`
+	ParentID int64  `json:"parentId,omitempty"`
+}
+
+type RoomData struct {
+	RoomID int64 `json:"roomId"`
+}
+
+// SubscribeData resumes the room after Since when it is set. With ThreadID set
+// only the replies to that message are delivered instead of the whole room.
+type SubscribeData struct {
+	RoomID   int64  `json:"roomId"`
+	Since    *int64 `json:"since,omitempty"`
+	ThreadID int64  `json:"threadId,omitempty"`
+}
+
+// UnsubscribeData leaves the room, or just the thread when ThreadID is set.
+type UnsubscribeData struct {
+	RoomID   int64 `json:"roomId"`
+	ThreadID int64 `json:"threadId,omitempty"`
+}
+
+type AckData struct {
+	RoomID int64 `json:"roomId"`
+	Seq    int64 `json:"seq"`
+}
+
+// ReadData marks the room as read up to and including Seq.
+type ReadData struct {
+	RoomID int64 `json:"roomId"`
+	Seq    int64 `json:"seq"`
+}
+
+// EditData replaces the content of the message with ID MessageID.
+type EditData struct {
+	MessageID int64  `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+type DeleteData struct {
+	MessageID int64 `json:"messageId"`
+}
+
+// ReactionData adds or removes the user's Emoji reaction to the message with ID MessageID.
+type ReactionData struct {
+	MessageID int64  `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// PinData pins or unpins the message with ID MessageID in the room.
+type PinData struct {
+	RoomID    int64 `json:"roomId"`
+	MessageID int64 `json:"messageId"`
+}
+
+// PresenceData sets the status of the connection: online, idle or dnd.
+type PresenceData struct {
+	Status string `json:"status"`
+}
+
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, a ...any) *ProtocolError {
+	return &ProtocolError{Code: CodeBadRequest, Message: fmt.Sprintf(format, a...)}
+}
+
+type opHandler func(hub *Hub, c *Client, env *Envelope) *ProtocolError
+
+var opHandlers = map[string]opHandler{
+	OpSend:        handleSend,
+	OpSubscribe:   handleSubscribe,
+	OpUnsubscribe: handleUnsubscribe,
+	OpAck:         handleAck,
+	OpTypingStart: handleTyping,
+	OpTypingStop:  handleTyping,
+	OpRead:        handleRead,
+	OpHeartbeat:   handleHeartbeat,
+	OpPresence:    handlePresence,
+	OpEdit:        handleEdit,
+	OpDelete:      handleDelete,
+	OpReactAdd:    handleReaction,
+	OpReactRemove: handleReaction,
+	OpPin:         handlePin,
+	OpUnpin:       handlePin,
+}
+
+// parseEnvelope decodes and validates the outer frame. Data is validated by the op handler.
+func parseEnvelope(frame []byte) (*Envelope, *ProtocolError) {
+	var env Envelope
+	if err := decodeStrict(frame, &env); err != nil {
+		return nil, badRequest("invalid frame: %v", err)
+	}
+	if env.Op == "" {
+		return &env, badRequest("op is required")
+	}
+	if _, ok := opHandlers[env.Op]; !ok {
+		return &env, &ProtocolError{Code: CodeUnknownOp, Message: fmt.Sprintf("unknown op %q", env.Op)}
+	}
+	return &env, nil
+}
+
+func decodeStrict(raw []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func decodeData(env *Envelope, v any) *ProtocolError {
+	if len(env.Data) == 0 {
+		return badRequest("data is required for op %q", env.Op)
+	}
+	if err := decodeStrict(env.Data, v); err != nil {
+		return badRequest("invalid data for op %q: %v", env.Op, err)
+	}
+	return nil
+}
+
+func handleSend(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data SendData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 {
+		return badRequest("roomId is required")
+	}
+	if data.ParentID < 0 {
+		return badRequest("parentId must be a message id")
+	}
+	if perr := checkContent(data.Content); perr != nil {
+		return perr
+	}
+
+	hub.send(c, env.Ref, &Message{
+		Content:  data.Content,
+		RoomID:   data.RoomID,
+		Username: c.Username,
+		SenderID: c.ID,
+		Type:     Normal,
+		ParentID: data.ParentID,
+	})
+	return nil
+}
+
+func checkContent(content string) *ProtocolError {
+	if strings.TrimSpace(content) == "" {
+		return badRequest("content must not be empty")
+	}
+	if len(content) > MaxContentLength {
+		return badRequest("content must be at most %d bytes", MaxContentLength)
+	}
+	return nil
+}
+
+func decodeRoomData(env *Envelope) (*RoomData, *ProtocolError) {
+	var data RoomData
+	if err := decodeData(env, &data); err != nil {
+		return nil, err
+	}
+	if data.RoomID <= 0 {
+		return nil, badRequest("roomId is required")
+	}
+	return &data, nil
+}
+
+func handleSubscribe(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data SubscribeData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 {
+		return badRequest("roomId is required")
+	}
+	if data.Since != nil && *data.Since < 0 {
+		return badRequest("since must not be negative")
+	}
+	if data.ThreadID < 0 || data.ThreadID > 0 && data.Since != nil {
+		return badRequest("threadId must be a message id and cannot be combined with since")
+	}
+
+	_, err := hub.joiner.JoinChatroom(context.Background(), &domain.JoinLeaveChatroomReq{
+		ID:       data.RoomID,
+		ClientID: c.ID,
+	})
+	if err != nil {
+		return &ProtocolError{Code: CodeForbidden, Message: err.Error()}
+	}
+
+	if data.ThreadID != 0 {
+		m, err := hub.messages.GetMessage(context.Background(), data.ThreadID)
+		if err != nil {
+			return serviceError(err)
+		}
+		if m.RoomID != data.RoomID || m.ParentID != 0 {
+			return badRequest("message %d does not start a thread in room %d", data.ThreadID, data.RoomID)
+		}
+	}
+
+	sub := &subscription{client: c, roomID: data.RoomID, ref: env.Ref, threadID: data.ThreadID}
+	if data.Since != nil {
+		sub.resume, sub.since = true, *data.Since
+	}
+	hub.subscribe(sub)
+	return nil
+}
+
+func handleUnsubscribe(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data UnsubscribeData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 {
+		return badRequest("roomId is required")
+	}
+
+	hub.unsubscribe(&subscription{client: c, roomID: data.RoomID, ref: env.Ref, threadID: data.ThreadID})
+	return nil
+}
+
+func handleAck(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data AckData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 || data.Seq <= 0 {
+		return badRequest("roomId and seq are required")
+	}
+
+	c.setAck(data.RoomID, data.Seq)
+	return nil
+}
+
+func handleTyping(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	data, perr := decodeRoomData(env)
+	if perr != nil {
+		return perr
+	}
+
+	hub.setTyping(&typingRequest{client: c, roomID: data.RoomID, start: env.Op == OpTypingStart, ref: env.Ref})
+	return nil
+}
+
+func handleRead(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data ReadData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 || data.Seq <= 0 {
+		return badRequest("roomId and seq are required")
+	}
+
+	receipt, err := hub.messages.MarkRead(context.Background(), &domain.MarkReadReq{
+		RoomID: data.RoomID,
+		UserID: c.ID,
+		Seq:    data.Seq,
+	})
+	if err != nil {
+		return serviceError(err)
+	}
+
+	hub.event(&outbound{message: readReceiptMessage(receipt, c.Username), sender: c, ref: env.Ref})
+	return nil
+}
+
+func handleHeartbeat(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	hub.presence <- &presenceRequest{client: c, ref: env.Ref}
+	return nil
+}
+
+func handlePresence(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data PresenceData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	switch data.Status {
+	case domain.PresenceOnline, domain.PresenceIdle, domain.PresenceDND:
+	default:
+		return badRequest("status must be one of %s, %s, %s", domain.PresenceOnline, domain.PresenceIdle, domain.PresenceDND)
+	}
+
+	hub.presence <- &presenceRequest{client: c, status: data.Status, ref: env.Ref}
+	return nil
+}
+
+func handleEdit(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data EditData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.MessageID <= 0 {
+		return badRequest("messageId is required")
+	}
+	if perr := checkContent(data.Content); perr != nil {
+		return perr
+	}
+
+	m, err := hub.messages.EditMessage(context.Background(), &domain.EditMessageReq{
+		ID:      data.MessageID,
+		UserID:  c.ID,
+		Content: data.Content,
+	})
+	if err != nil {
+		return serviceError(err)
+	}
+
+	hub.event(&outbound{message: updateMessage(m), sender: c, ref: env.Ref})
+	return nil
+}
+
+func handleDelete(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data DeleteData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.MessageID <= 0 {
+		return badRequest("messageId is required")
+	}
+
+	m, err := hub.messages.DeleteMessage(context.Background(), &domain.DeleteMessageReq{
+		ID:     data.MessageID,
+		UserID: c.ID,
+	})
+	if err != nil {
+		return serviceError(err)
+	}
+
+	hub.event(&outbound{message: updateMessage(m), sender: c, ref: env.Ref})
+	return nil
+}
+
+func handleReaction(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data ReactionData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.MessageID <= 0 {
+		return badRequest("messageId is required")
+	}
+	if !domain.ValidEmoji(data.Emoji) {
+		return badRequest("emoji must be at most %d bytes without spaces", domain.MaxEmojiLength)
+	}
+
+	reaction, err := hub.messages.React(context.Background(), &domain.ReactReq{
+		MessageID: data.MessageID,
+		UserID:    c.ID,
+		Emoji:     data.Emoji,
+		Remove:    env.Op == OpReactRemove,
+	})
+	if err != nil {
+		return serviceError(err)
+	}
+
+	message := reactionMessage(reaction, c.Username)
+	if reaction.Changed {
+		hub.event(&outbound{message: message, sender: c, ref: env.Ref})
+	} else if env.Ref != "" { // Nothing changed, so the room is not told
+		message.Type, message.Ref = Ack, env.Ref
+		hub.sendTo(c, message)
+	}
+	return nil
+}
+
+func handlePin(hub *Hub, c *Client, env *Envelope) *ProtocolError {
+	var data PinData
+	if err := decodeData(env, &data); err != nil {
+		return err
+	}
+	if data.RoomID <= 0 || data.MessageID <= 0 {
+		return badRequest("roomId and messageId are required")
+	}
+
+	req := &domain.PinReq{RoomID: data.RoomID, MessageID: data.MessageID, UserID: c.ID}
+	change, typ := hub.messages.PinMessage, MessagePinned
+	if env.Op == OpUnpin {
+		change, typ = hub.messages.UnpinMessage, MessageUnpinned
+	}
+	pin, err := change(context.Background(), req)
+	if err != nil {
+		return serviceError(err)
+	}
+
+	hub.event(&outbound{message: pinMessage(pin, c.ID, c.Username, typ), sender: c, ref: env.Ref})
+	return nil
+}
+
+// serviceError reports an error returned by a service to the client.
+func serviceError(err error) *ProtocolError {
+	switch {
+	case errors.Is(err, domain.ErrNotChatroomMember), errors.Is(err, domain.ErrNotMessageEditor), errors.Is(err, domain.ErrNotRoomModerator):
+		return &ProtocolError{Code: CodeForbidden, Message: err.Error()}
+	case errors.Is(err, domain.ErrChatroomIDNotFound), errors.Is(err, domain.ErrMessageIDNotFound), errors.Is(err, domain.ErrTooManyPins):
+		return badRequest(err.Error())
+	default:
+		log.Printf("service error: %v", err)
+		return &ProtocolError{Code: CodeInternal, Message: "something went wrong"}
+	}
+}
+
+func errorMessage(ref string, err *ProtocolError) *Message {
+	return &Message{
+		Content: err.Message,
+		Type:    Error,
+		Ref:     ref,
+		Code:    err.Code,
+	}
+}
@@ -0,0 +1,462 @@
+package ws_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"server/internal/domain"
+	"server/internal/ws"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// dialTestClient starts a server that joins every connection to roomID as user id
+// and returns the client side of the socket.
+func dialTestClient(t *testing.T, hub *ws.Hub, id, roomID int64) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := hub.NewClient(conn, id, "tester", "test")
+		go client.WriteMessage(hub)
+		hub.Register(client)
+		hub.Subscribe(client, roomID)
+		client.ReadMessage(hub)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.Equal(t, ws.Connected, readMessage(t, conn).Type)
+	return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) *ws.Message {
+	var m ws.Message
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, conn.ReadJSON(&m))
+	return &m
+}
+
+func TestProtocolSendIsBroadcastAndAcked(t *testing.T) {
+	hub := newTestHub()
+	conn := dialTestClient(t, hub, 1, 1)
+	require.Equal(t, "tester has joined the room", readMessage(t, conn).Content)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"hello"},"ref":"r1"}`)))
+
+	broadcast := readMessage(t, conn)
+	require.Equal(t, ws.Normal, broadcast.Type)
+	require.Equal(t, "hello", broadcast.Content)
+	require.Empty(t, broadcast.Ref)
+
+	ack := readMessage(t, conn)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "r1", ack.Ref)
+	require.Equal(t, broadcast.ID, ack.ID)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{forbidden: map[int64]bool{3: true}}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+	conn := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn)
+
+	cases := []struct {
+		frame string
+		ref   string
+		code  string
+	}{
+		{frame: `hello`, ref: "", code: ws.CodeBadRequest},
+		{frame: `{"op":"dance","ref":"r2"}`, ref: "r2", code: ws.CodeUnknownOp},
+		{frame: `{"data":{},"ref":"r3"}`, ref: "r3", code: ws.CodeBadRequest},
+		{frame: `{"op":"send","ref":"r4"}`, ref: "r4", code: ws.CodeBadRequest},
+		{frame: `{"op":"send","data":{"roomId":1,"content":"  "},"ref":"r5"}`, ref: "r5", code: ws.CodeBadRequest},
+		{frame: `{"op":"send","data":{"roomId":1,"content":"hi","extra":1},"ref":"r6"}`, ref: "r6", code: ws.CodeBadRequest},
+		{frame: `{"op":"send","data":{"content":"hi"},"ref":"r7"}`, ref: "r7", code: ws.CodeBadRequest},
+		{frame: `{"op":"send","data":{"roomId":2,"content":"hi"},"ref":"r8"}`, ref: "r8", code: ws.CodeBadRequest},
+		{frame: `{"op":"subscribe","data":{"roomId":3},"ref":"r9"}`, ref: "r9", code: ws.CodeForbidden},
+		{frame: `{"op":"unsubscribe","data":{"roomId":2},"ref":"r10"}`, ref: "r10", code: ws.CodeBadRequest},
+		{frame: `{"op":"typing_start","data":{"roomId":2},"ref":"r11"}`, ref: "r11", code: ws.CodeBadRequest},
+	}
+	for _, tc := range cases {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tc.frame)))
+		m := readMessage(t, conn)
+		require.Equal(t, ws.Error, m.Type, tc.frame)
+		require.Equal(t, tc.ref, m.Ref, tc.frame)
+		require.Equal(t, tc.code, m.Code, tc.frame)
+	}
+}
+
+func TestProtocolSubscribeMultiplexesRooms(t *testing.T) {
+	hub := newTestHub()
+	conn := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"subscribe","data":{"roomId":2},"ref":"s1"}`)))
+	joined := readMessage(t, conn)
+	require.Equal(t, int64(2), joined.RoomID)
+	require.Equal(t, "tester has joined the room", joined.Content)
+	ack := readMessage(t, conn)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "s1", ack.Ref)
+
+	hub.Broadcast(&ws.Message{Content: "in room 1", RoomID: 1, SenderID: 9, Type: ws.Normal})
+	hub.Broadcast(&ws.Message{Content: "in room 2", RoomID: 2, SenderID: 9, Type: ws.Normal})
+	// Rooms run independently, so only messages within a room are ordered
+	require.ElementsMatch(t, []int64{1, 2}, []int64{readMessage(t, conn).RoomID, readMessage(t, conn).RoomID})
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"unsubscribe","data":{"roomId":1},"ref":"u1"}`)))
+	ack = readMessage(t, conn)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "u1", ack.Ref)
+	require.Equal(t, []ws.ClientInfo{}, hub.OnlineClients(1))
+	require.Equal(t, 1, len(hub.OnlineClients(2)))
+}
+
+func TestProtocolResubscribeResumesAfterAck(t *testing.T) {
+	hub := newTestHub()
+	conn := dialTestClient(t, hub, 1, 1)
+	joined := readMessage(t, conn)
+	require.Equal(t, int64(1), joined.Seq)
+
+	hub.Broadcast(&ws.Message{Content: "seen", RoomID: 1, SenderID: 9, Type: ws.Normal})
+	seen := readMessage(t, conn)
+	require.Equal(t, int64(2), seen.Seq)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"ack","data":{"roomId":1,"seq":2}}`)))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"unsubscribe","data":{"roomId":1},"ref":"u1"}`)))
+	require.Equal(t, ws.Ack, readMessage(t, conn).Type)
+	hub.Broadcast(&ws.Message{Content: "missed", RoomID: 1, SenderID: 9, Type: ws.Normal})
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"subscribe","data":{"roomId":1},"ref":"s1"}`)))
+	missed := readMessage(t, conn)
+	require.Equal(t, "missed", missed.Content)
+	require.Equal(t, int64(3), missed.Seq)
+	require.Equal(t, "tester has joined the room", readMessage(t, conn).Content)
+	require.Equal(t, ws.Ack, readMessage(t, conn).Type)
+}
+
+func TestProtocolSubscribeSince(t *testing.T) {
+	hub := newTestHub()
+	conn := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn)
+
+	hub.Broadcast(&ws.Message{Content: "first", RoomID: 2, SenderID: 9, Type: ws.Normal})
+	hub.Broadcast(&ws.Message{Content: "second", RoomID: 2, SenderID: 9, Type: ws.Normal})
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"subscribe","data":{"roomId":2,"since":1},"ref":"s1"}`)))
+	replayed := readMessage(t, conn)
+	require.Equal(t, "second", replayed.Content)
+	require.Equal(t, int64(2), replayed.Seq)
+	require.Equal(t, "tester has joined the room", readMessage(t, conn).Content)
+	require.Equal(t, ws.Ack, readMessage(t, conn).Type)
+}
+
+func TestProtocolTypingReachesOthersOnly(t *testing.T) {
+	hub := newTestHub()
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_start","data":{"roomId":1},"ref":"t1"}`)))
+	require.Equal(t, "t1", readMessage(t, conn1).Ref)
+	started := readMessage(t, conn2)
+	require.Equal(t, ws.TypingStart, started.Type)
+	require.Equal(t, int64(1), started.SenderID)
+	require.Zero(t, started.Seq)
+
+	// Renewing is not sent to the room again, so the next event conn2 sees is the stop
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_start","data":{"roomId":1},"ref":"t2"}`)))
+	require.Equal(t, "t2", readMessage(t, conn1).Ref)
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_stop","data":{"roomId":1},"ref":"t3"}`)))
+	require.Equal(t, "t3", readMessage(t, conn1).Ref)
+	require.Equal(t, ws.TypingStop, readMessage(t, conn2).Type)
+}
+
+func TestProtocolTypingExpires(t *testing.T) {
+	config := ws.DefaultConfig()
+	config.TypingTimeout = 100 * time.Millisecond
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_start","data":{"roomId":1}}`)))
+	require.Equal(t, ws.TypingStart, readMessage(t, conn2).Type)
+	require.Equal(t, ws.TypingStop, readMessage(t, conn2).Type)
+}
+
+func TestProtocolTypingRateLimited(t *testing.T) {
+	hub := newTestHub()
+	conn := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn)
+
+	for i := 0; i < ws.TypingRateLimit; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_start","data":{"roomId":1},"ref":"t"}`)))
+		require.Equal(t, ws.Ack, readMessage(t, conn).Type)
+	}
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"typing_start","data":{"roomId":1},"ref":"t"}`)))
+	limited := readMessage(t, conn)
+	require.Equal(t, ws.Error, limited.Type)
+	require.Equal(t, ws.CodeRateLimited, limited.Code)
+}
+
+func TestProtocolReadReceipt(t *testing.T) {
+	hub := newTestHub()
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	joined := readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"read","data":{"roomId":1,"seq":%d},"ref":"r1"}`, joined.Seq))))
+
+	// Every member of the room gets the receipt, including the reader's own connections
+	receipt := readMessage(t, conn1)
+	require.Equal(t, ws.ReadReceipt, receipt.Type)
+	require.Equal(t, int64(2), receipt.SenderID)
+	require.Equal(t, joined.Seq, receipt.LastReadSeq)
+	require.Equal(t, ws.ReadReceipt, readMessage(t, conn2).Type)
+	ack := readMessage(t, conn2)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "r1", ack.Ref)
+	require.Equal(t, joined.Seq, ack.LastReadSeq)
+}
+
+func TestProtocolPresence(t *testing.T) {
+	store := &memoryPresenceStore{contacts: map[int64][]int64{1: {2}}}
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, store, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	// The presence of user 1 waits for their contacts, so it may come after their join
+	presence, joined := readMessage(t, conn2), readMessage(t, conn2)
+	if presence.Type != ws.Presence {
+		presence = joined
+	}
+	require.Equal(t, domain.PresenceOnline, presence.Status)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"presence","data":{"status":"dnd"},"ref":"p1"}`)))
+	ack := readMessage(t, conn1)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, domain.PresenceDND, ack.Status)
+	dnd := readMessage(t, conn2)
+	require.Equal(t, ws.Presence, dnd.Type)
+	require.Equal(t, int64(1), dnd.SenderID)
+	require.Equal(t, domain.PresenceDND, dnd.Status)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"heartbeat","ref":"h1"}`)))
+	require.Equal(t, "h1", readMessage(t, conn1).Ref)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"presence","data":{"status":"away"},"ref":"p2"}`)))
+	require.Equal(t, ws.CodeBadRequest, readMessage(t, conn1).Code)
+}
+
+func TestProtocolEditAndDelete(t *testing.T) {
+	hub := newTestHub()
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"helo"}}`)))
+	sent := readMessage(t, conn1)
+	require.Equal(t, sent.ID, readMessage(t, conn2).ID)
+
+	// Only the sender may change the message
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_edit","data":{"messageId":%d,"content":"mine"},"ref":"e0"}`, sent.ID))))
+	forbidden := readMessage(t, conn2)
+	require.Equal(t, ws.Error, forbidden.Type)
+	require.Equal(t, ws.CodeForbidden, forbidden.Code)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_edit","data":{"messageId":%d,"content":"hello"},"ref":"e1"}`, sent.ID))))
+	edited := readMessage(t, conn2)
+	require.Equal(t, ws.MessageEdited, edited.Type)
+	require.Equal(t, sent.ID, edited.ID)
+	require.Equal(t, "hello", edited.Content)
+	require.NotNil(t, edited.EditedAt)
+	require.Equal(t, ws.MessageEdited, readMessage(t, conn1).Type)
+	ack := readMessage(t, conn1)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "e1", ack.Ref)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_delete","data":{"messageId":%d},"ref":"d1"}`, sent.ID))))
+	tombstone := readMessage(t, conn2)
+	require.Equal(t, ws.MessageDeleted, tombstone.Type)
+	require.Equal(t, sent.ID, tombstone.ID)
+	require.Empty(t, tombstone.Content)
+	require.NotNil(t, tombstone.DeletedAt)
+	require.Equal(t, ws.MessageDeleted, readMessage(t, conn1).Type)
+	require.Equal(t, "d1", readMessage(t, conn1).Ref)
+
+	// A tombstone cannot be edited
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_edit","data":{"messageId":%d,"content":"back"},"ref":"e2"}`, sent.ID))))
+	gone := readMessage(t, conn1)
+	require.Equal(t, ws.Error, gone.Type)
+	require.Equal(t, ws.CodeBadRequest, gone.Code)
+}
+
+func TestProtocolReactions(t *testing.T) {
+	hub := newTestHub()
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"lunch?"}}`)))
+	sent := readMessage(t, conn1)
+	readMessage(t, conn2)
+
+	react := func(conn *websocket.Conn, op, ref string) {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":%q,"data":{"messageId":%d,"emoji":"🍕"},"ref":%q}`, op, sent.ID, ref))))
+	}
+
+	react(conn2, "reaction_add", "a1")
+	added := readMessage(t, conn1)
+	require.Equal(t, ws.ReactionAdded, added.Type)
+	require.Equal(t, sent.ID, added.ID)
+	require.Equal(t, int64(2), added.SenderID)
+	require.Equal(t, "🍕", added.Emoji)
+	require.Equal(t, 1, added.Count)
+	require.Equal(t, ws.ReactionAdded, readMessage(t, conn2).Type)
+	require.Equal(t, "a1", readMessage(t, conn2).Ref)
+
+	// Reacting again is acked without telling the room
+	react(conn2, "reaction_add", "a2")
+	ack := readMessage(t, conn2)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, "a2", ack.Ref)
+	require.Equal(t, 1, ack.Count)
+
+	react(conn2, "reaction_remove", "r1")
+	removed := readMessage(t, conn1)
+	require.Equal(t, ws.ReactionRemoved, removed.Type)
+	require.Zero(t, removed.Count)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"reaction_add","data":{"messageId":1,"emoji":"two words"},"ref":"bad"}`)))
+	invalid := readMessage(t, conn1)
+	require.Equal(t, ws.Error, invalid.Type)
+	require.Equal(t, ws.CodeBadRequest, invalid.Code)
+}
+
+func TestProtocolThreads(t *testing.T) {
+	hub := newTestHub()
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 2) // Follows a thread of room 1 without subscribing to it
+	readMessage(t, conn2)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"release today?"}}`)))
+	parent := readMessage(t, conn1)
+
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"subscribe","data":{"roomId":1,"threadId":%d},"ref":"f1"}`, parent.ID))))
+	ack := readMessage(t, conn2)
+	require.Equal(t, ws.Ack, ack.Type)
+	require.Equal(t, parent.ID, ack.ParentID)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"unrelated"}}`)))
+	readMessage(t, conn1)
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"send","data":{"roomId":1,"content":"yes","parentId":%d},"ref":"r1"}`, parent.ID))))
+
+	// The room gets the reply and the new reply count of the parent
+	reply := readMessage(t, conn1)
+	require.Equal(t, "yes", reply.Content)
+	require.Equal(t, parent.ID, reply.ParentID)
+	updated := readMessage(t, conn1)
+	require.Equal(t, ws.ThreadUpdated, updated.Type)
+	require.Equal(t, parent.ID, updated.ID)
+	require.Equal(t, 1, updated.ReplyCount)
+	require.NotNil(t, updated.LastReplyAt)
+	require.Equal(t, "r1", readMessage(t, conn1).Ref)
+
+	// and so does the follower of the thread, but nothing else from the room
+	require.Equal(t, reply.ID, readMessage(t, conn2).ID)
+	require.Equal(t, ws.ThreadUpdated, readMessage(t, conn2).Type)
+
+	// Threads are one level deep
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"send","data":{"roomId":1,"content":"nested","parentId":%d},"ref":"r2"}`, reply.ID))))
+	nested := readMessage(t, conn1)
+	require.Equal(t, ws.Error, nested.Type)
+	require.Equal(t, ws.CodeBadRequest, nested.Code)
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"subscribe","data":{"roomId":1,"threadId":%d},"ref":"f2"}`, reply.ID))))
+	require.Equal(t, ws.CodeBadRequest, readMessage(t, conn2).Code)
+
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"unsubscribe","data":{"roomId":1,"threadId":%d},"ref":"u1"}`, parent.ID))))
+	require.Equal(t, ws.Ack, readMessage(t, conn2).Type)
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"unsubscribe","data":{"roomId":1,"threadId":%d},"ref":"u2"}`, parent.ID))))
+	require.Equal(t, ws.CodeBadRequest, readMessage(t, conn2).Code)
+}
+
+func TestProtocolMentionReachesUserOutsideRoom(t *testing.T) {
+	messages := &memoryMessageService{users: map[string]int64{"alice": 1, "bob": 2}}
+	hub := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 2) // bob is not subscribed to room 1
+	readMessage(t, conn2)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"@bob @carol @alice see above, mail alice@bob.com"}}`)))
+	sent := readMessage(t, conn1)
+	require.Equal(t, []int64{2}, sent.Mentions)
+
+	mention := readMessage(t, conn2)
+	require.Equal(t, ws.Mention, mention.Type)
+	require.Equal(t, sent.ID, mention.ID)
+	require.Equal(t, int64(1), mention.RoomID)
+	require.Equal(t, sent.Content, mention.Content)
+}
+
+func TestProtocolPins(t *testing.T) {
+	messages := &memoryMessageService{moderators: map[int64]bool{1: true}}
+	hub := ws.NewHub(messages, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), ws.DefaultConfig())
+	go hub.Run()
+
+	conn1 := dialTestClient(t, hub, 1, 1)
+	readMessage(t, conn1)
+	conn2 := dialTestClient(t, hub, 2, 1)
+	readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(`{"op":"send","data":{"roomId":1,"content":"house rules"}}`)))
+	sent := readMessage(t, conn2)
+	readMessage(t, conn1)
+
+	// Only moderators pin
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_pin","data":{"roomId":1,"messageId":%d},"ref":"p0"}`, sent.ID))))
+	require.Equal(t, ws.CodeForbidden, readMessage(t, conn2).Code)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_pin","data":{"roomId":1,"messageId":%d},"ref":"p1"}`, sent.ID))))
+	pinned := readMessage(t, conn2)
+	require.Equal(t, ws.MessagePinned, pinned.Type)
+	require.Equal(t, sent.ID, pinned.ID)
+	require.Equal(t, int64(1), pinned.SenderID)
+	require.Equal(t, "house rules", pinned.Pin.Message.Content)
+	require.Equal(t, ws.MessagePinned, readMessage(t, conn1).Type)
+	require.Equal(t, "p1", readMessage(t, conn1).Ref)
+
+	require.NoError(t, conn1.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"op":"message_unpin","data":{"roomId":1,"messageId":%d},"ref":"u1"}`, sent.ID))))
+	unpinned := readMessage(t, conn2)
+	require.Equal(t, ws.MessageUnpinned, unpinned.Type)
+	require.Equal(t, sent.ID, unpinned.ID)
+	require.Nil(t, unpinned.Pin)
+}
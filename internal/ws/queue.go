@@ -0,0 +1,191 @@
+package ws
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// QueuePolicy decides what happens to a message for a client whose send queue is full.
+type QueuePolicy int
+
+const (
+	// DropOldest discards the oldest queued message. The client notices the gap in
+	// seq and resumes to get stored messages back.
+	DropOldest QueuePolicy = iota
+	// Disconnect closes the connection with CloseTryAgainLater.
+	Disconnect
+	// Coalesce merges queued events superseded by newer ones for the same user and room
+	// (typing, read receipts, presence) and disconnects the client if that frees no room.
+	Coalesce
+)
+
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch s {
+	case "drop_oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "coalesce":
+		return Coalesce, nil
+	}
+	return 0, fmt.Errorf("unknown queue policy %q", s)
+}
+
+// QueueStats describes the send queues of the clients connected to a hub.
+type QueueStats struct {
+	Clients   int   `json:"clients"`
+	Queued    int   `json:"queued"`   // Messages waiting in all send queues
+	MaxDepth  int   `json:"maxDepth"` // Messages waiting in the fullest send queue
+	Capacity  int   `json:"capacity"`
+	Dropped   int64 `json:"dropped"`
+	Coalesced int64 `json:"coalesced"`
+	Evicted   int64 `json:"evicted"`
+}
+
+// QueueStats returns the current depth of the send queues and what the queue
+// policy had to do so far.
+func (h *Hub) QueueStats() QueueStats {
+	var stats QueueStats
+	h.query(func() {
+		for _, sessions := range h.users {
+			for _, c := range sessions {
+				depth := len(c.Message)
+				stats.Clients++
+				stats.Queued += depth
+				if depth > stats.MaxDepth {
+					stats.MaxDepth = depth
+				}
+			}
+		}
+	})
+	stats.Capacity = h.config.SendQueueSize
+	stats.Dropped = atomic.LoadInt64(&h.dropped)
+	stats.Coalesced = atomic.LoadInt64(&h.coalesced)
+	stats.Evicted = atomic.LoadInt64(&h.evictions)
+	return stats
+}
+
+// enqueue hands a message to the client's writer. It never blocks: when the queue
+// is full the queue policy applies. The rooms and the hub all call it, so the
+// client's lock makes the policy's changes to the queue atomic.
+func (h *Hub) enqueue(client *Client, message *Message) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed || client.evicted {
+		return
+	}
+	select {
+	case client.Message <- message:
+		return
+	default:
+	}
+
+	switch h.config.QueuePolicy {
+	case DropOldest:
+		select {
+		case <-client.Message:
+		default: // The writer just made room
+		}
+		atomic.AddInt64(&h.dropped, 1)
+		client.Message <- message // Only senders holding the lock fill the queue, so there is room now
+	case Coalesce:
+		if h.coalesce(client, message) {
+			return
+		}
+		h.evict(client)
+	default:
+		h.evict(client)
+	}
+}
+
+// coalesce rewrites the client's queue without superseded events, followed by
+// message. It reports whether everything fit; if not, the newest messages are left out.
+func (h *Hub) coalesce(client *Client, message *Message) bool {
+	var queued []*Message
+drain:
+	for {
+		select {
+		case m := <-client.Message:
+			queued = append(queued, m)
+		default:
+			break drain
+		}
+	}
+	merged := coalesceMessages(append(queued, message))
+	atomic.AddInt64(&h.coalesced, int64(len(queued)+1-len(merged)))
+
+	fits := len(merged) <= cap(client.Message)
+	if !fits {
+		merged = merged[:cap(client.Message)]
+	}
+	for _, m := range merged {
+		client.Message <- m
+	}
+	return fits
+}
+
+type coalesceKey struct {
+	kind   MessageType
+	roomID int64
+	userID int64
+}
+
+// coalesceMessages drops every event followed by a newer one for the same user and
+// room. Stored messages and replies are always kept.
+func coalesceMessages(messages []*Message) []*Message {
+	seen := make(map[coalesceKey]bool)
+	keep := make([]bool, len(messages))
+	kept := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		var key coalesceKey
+		switch m.Type {
+		case TypingStart, TypingStop:
+			key = coalesceKey{kind: TypingStart, roomID: m.RoomID, userID: m.SenderID}
+		case ReadReceipt:
+			key = coalesceKey{kind: ReadReceipt, roomID: m.RoomID, userID: m.SenderID}
+		case Presence:
+			key = coalesceKey{kind: Presence, userID: m.SenderID}
+		default:
+			keep[i] = true
+			kept++
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			keep[i] = true
+			kept++
+		}
+	}
+
+	res := make([]*Message, 0, kept)
+	for i, m := range messages {
+		if keep[i] {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// evict marks a client too slow to keep up and has the hub disconnect it. The
+// caller may be a room the hub is waiting on, so the hub is told asynchronously.
+func (h *Hub) evict(client *Client) {
+	client.evicted = true
+	go func() {
+		h.evicted <- client
+	}()
+}
+
+func (h *Hub) disconnectSlow(client *Client) {
+	if !h.isConnected(client) {
+		return
+	}
+	log.Printf("disconnecting slow session %s of user %d", client.SessionID, client.ID)
+	atomic.AddInt64(&h.evictions, 1)
+	client.closeCode, client.closeText = websocket.CloseTryAgainLater, "slow consumer"
+	h.disconnect(client)
+	h.updatePresence(client.ID, client.Username)
+}
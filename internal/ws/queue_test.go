@@ -0,0 +1,117 @@
+package ws_test
+
+import (
+	"fmt"
+	"server/internal/domain"
+	"server/internal/ws"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newQueueHub(size int, policy ws.QueuePolicy) *ws.Hub {
+	config := ws.DefaultConfig()
+	config.SendQueueSize, config.QueuePolicy = size, policy
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+	return hub
+}
+
+// stalledClient registers a client nobody reads from, with the connected and join
+// messages filling the first two slots of its queue.
+func stalledClient(hub *ws.Hub, id int64, roomID int64) *ws.Client {
+	client := hub.NewClient(nil, id, fmt.Sprintf("user%d", id), "test")
+	hub.Register(client)
+	hub.Subscribe(client, roomID)
+	return client
+}
+
+// drainQueue returns the queued messages, waiting for the channel to be closed if closed is set.
+func drainQueue(t *testing.T, client *ws.Client, closed bool) []*ws.Message {
+	var messages []*ws.Message
+	for {
+		select {
+		case m, ok := <-client.Message:
+			if !ok {
+				require.True(t, closed, "queue was closed")
+				return messages
+			}
+			messages = append(messages, m)
+		case <-time.After(100 * time.Millisecond):
+			require.False(t, closed, "queue was not closed")
+			return messages
+		}
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	hub := newQueueHub(3, ws.DropOldest)
+	client := stalledClient(hub, 1, 1)
+
+	for i := 0; i < 5; i++ {
+		hub.Broadcast(&ws.Message{Content: fmt.Sprintf("message %d", i), RoomID: 1, SenderID: 2, Type: ws.Normal})
+	}
+	require.Len(t, hub.OnlineClients(1), 1) // Runs after the broadcasts
+
+	stats := hub.QueueStats()
+	require.Equal(t, 1, stats.Clients)
+	require.Equal(t, 3, stats.MaxDepth)
+	require.Equal(t, 3, stats.Capacity)
+	require.EqualValues(t, 4, stats.Dropped)
+	require.Zero(t, stats.Evicted)
+
+	var contents []string
+	for _, m := range drainQueue(t, client, false) {
+		contents = append(contents, m.Content)
+	}
+	require.Equal(t, []string{"message 2", "message 3", "message 4"}, contents)
+}
+
+func TestQueueDisconnectEvictsSlowClient(t *testing.T) {
+	hub := newQueueHub(3, ws.Disconnect)
+	client := stalledClient(hub, 1, 1)
+	hub.Broadcast(&ws.Message{Content: "fills the queue", RoomID: 1, SenderID: 3, Type: ws.Normal})
+	require.Len(t, hub.OnlineClients(1), 1) // Runs after the broadcast
+
+	// The other user's join message overflows the stalled client's queue. Theirs
+	// holds everything they are sent, so only the stalled client can be evicted.
+	_, other := streamClient(hub, 2, 1)
+	awaitContents(t, other, 1, "user2 has joined the room", "user1 left the room")
+	require.Eventually(t, func() bool {
+		return hub.QueueStats().Evicted == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stats := hub.QueueStats()
+	require.Equal(t, 1, stats.Clients)
+	require.EqualValues(t, 1, stats.Evicted)
+
+	messages := drainQueue(t, client, true)
+	require.Len(t, messages, 3)
+	require.Equal(t, ws.Connected, messages[0].Type)
+	require.Len(t, hub.OnlineClients(1), 1)
+}
+
+func TestQueueCoalesceMergesReadReceipts(t *testing.T) {
+	hub := newQueueHub(3, ws.Coalesce)
+	client := stalledClient(hub, 1, 1)
+
+	for seq := int64(1); seq <= 5; seq++ {
+		hub.Read(&domain.ReadReceipt{RoomID: 1, UserID: 2, LastReadSeq: seq, ReadAt: time.Now()}, "user2")
+	}
+	hub.OnlineClients(1)
+	stats := hub.QueueStats()
+	require.EqualValues(t, 4, stats.Coalesced)
+	require.Zero(t, stats.Evicted)
+
+	// Nothing is left to merge for a stored message
+	hub.Broadcast(&ws.Message{Content: "overflow", RoomID: 1, SenderID: 2, Type: ws.Normal})
+	require.Eventually(t, func() bool {
+		return hub.QueueStats().Evicted == 1
+	}, time.Second, 10*time.Millisecond)
+
+	messages := drainQueue(t, client, true)
+	require.Len(t, messages, 3)
+	require.Equal(t, ws.ReadReceipt, messages[2].Type)
+	require.EqualValues(t, 5, messages[2].LastReadSeq)
+}
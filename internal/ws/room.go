@@ -0,0 +1,404 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"server/internal/domain"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RoomIdleTimeout is the default Config.RoomIdleTimeout.
+	RoomIdleTimeout = time.Minute
+	// roomQueueSize is how many operations may wait for a room before callers block.
+	roomQueueSize = 64
+)
+
+// Room is a chat room with clients connected to this instance. Each room runs its
+// own goroutine, which owns everything below; other goroutines hand it work
+// through Hub.inRoom. A room is started on first use and stops once it has been
+// empty for the hub's RoomIdleTimeout.
+type Room struct {
+	ID      int64              `json:"id"`
+	Name    string             `json:"name"`
+	Clients map[string]*Client `json:"clients"` // Keyed by session ID
+
+	hub      *Hub
+	ops      chan func()
+	pending  int64                        // Operations sent to ops but not run yet, incremented under hub.roomsMu
+	members  map[int64]int                // Number of subscribed sessions per user
+	threads  map[int64]map[string]*Client // Sessions following a thread but not the room, keyed by thread and session ID
+	typing   map[int64]*typist            // Users typing in the room, keyed by user ID
+	replayed map[string]int64             // Highest sequence number sent to a session by a replay, keyed by session ID
+	idle     time.Time                    // When the room last became empty
+}
+
+func newRoom(hub *Hub, id int64) *Room {
+	return &Room{
+		ID:       id,
+		Clients:  make(map[string]*Client),
+		hub:      hub,
+		ops:      make(chan func(), roomQueueSize),
+		members:  make(map[int64]int),
+		threads:  make(map[int64]map[string]*Client),
+		typing:   make(map[int64]*typist),
+		replayed: make(map[string]int64),
+		idle:     time.Now(),
+	}
+}
+
+// inRoom runs fn on the room's goroutine, starting the room first if create is set.
+// It reports whether the room was running; fn has not necessarily run yet when it returns.
+// Operations handed to the same room run in the order they were handed over.
+func (h *Hub) inRoom(roomID int64, create bool, fn func(r *Room)) bool {
+	h.roomsMu.Lock()
+	room, ok := h.rooms[roomID]
+	if !ok {
+		if !create {
+			h.roomsMu.Unlock()
+			return false
+		}
+		room = newRoom(h, roomID)
+		h.rooms[roomID] = room
+		go room.run()
+	}
+	atomic.AddInt64(&room.pending, 1)
+	h.roomsMu.Unlock()
+
+	room.ops <- func() { fn(room) }
+	return true
+}
+
+// ActiveRooms returns the number of rooms with a running goroutine.
+func (h *Hub) ActiveRooms() int {
+	h.roomsMu.Lock()
+	defer h.roomsMu.Unlock()
+	return len(h.rooms)
+}
+
+func (r *Room) run() {
+	tick := r.hub.config.TypingTimeout
+	if r.hub.config.RoomIdleTimeout < tick {
+		tick = r.hub.config.RoomIdleTimeout
+	}
+	ticker := time.NewTicker(tick / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op := <-r.ops:
+			atomic.AddInt64(&r.pending, -1)
+			op()
+		case now := <-ticker.C:
+			r.expireTyping(now)
+			if r.empty() && now.Sub(r.idle) >= r.hub.config.RoomIdleTimeout && r.stop() {
+				return
+			}
+		}
+	}
+}
+
+// stop removes the room from the hub unless an operation is on its way to it.
+func (r *Room) stop() bool {
+	r.hub.roomsMu.Lock()
+	defer r.hub.roomsMu.Unlock()
+	if atomic.LoadInt64(&r.pending) != 0 {
+		return false
+	}
+	delete(r.hub.rooms, r.ID)
+	return true
+}
+
+func (r *Room) isSubscribed(client *Client) bool {
+	return r.Clients[client.SessionID] == client
+}
+
+// empty reports whether no session follows the room or any of its threads.
+func (r *Room) empty() bool {
+	return len(r.Clients) == 0 && len(r.threads) == 0
+}
+
+// follow delivers the replies to one message of the room, and the events about
+// that message and its replies, to a client that need not be subscribed to the room.
+func (r *Room) follow(sub *subscription) {
+	client := sub.client
+	if r.threads[sub.threadID] == nil {
+		r.threads[sub.threadID] = make(map[string]*Client)
+	}
+	r.threads[sub.threadID][client.SessionID] = client
+	if sub.ref != "" {
+		r.hub.sendTo(client, &Message{RoomID: r.ID, ParentID: sub.threadID, Type: Ack, Ref: sub.ref})
+	}
+}
+
+// unfollow stops delivering the thread to the client. It reports whether the client followed it.
+func (r *Room) unfollow(client *Client, threadID int64) bool {
+	if r.threads[threadID][client.SessionID] != client {
+		return false
+	}
+	delete(r.threads[threadID], client.SessionID)
+	if len(r.threads[threadID]) == 0 {
+		delete(r.threads, threadID)
+	}
+	if r.empty() {
+		r.idle = time.Now()
+	}
+	return true
+}
+
+func (r *Room) unfollowAll(client *Client) {
+	for threadID := range r.threads {
+		r.unfollow(client, threadID)
+	}
+}
+
+func (r *Room) addSubscription(sub *subscription) {
+	client := sub.client
+	if !r.isSubscribed(client) {
+		acked, ok := client.lastAck(r.ID)
+		if !sub.resume && ok { // Resubscribing on the same session picks up after the last ack
+			sub.resume, sub.since = true, acked
+		}
+		if sub.resume {
+			r.replay(client, sub.since, sub.ref)
+		}
+
+		joined := r.members[client.ID] > 0
+		r.Clients[client.SessionID] = client
+		r.members[client.ID]++
+		if !joined { // Only announce the user's first device
+			r.deliver(&Message{ // Broadcast a message saying that the user has joined the room
+				Content:  client.Username + " has joined the room",
+				RoomID:   r.ID,
+				Username: client.Username,
+				SenderID: client.ID,
+				Type:     Normal,
+
+				announcement: true,
+			})
+		}
+	}
+	if sub.ref != "" {
+		r.hub.sendTo(client, &Message{RoomID: r.ID, Type: Ack, Ref: sub.ref})
+	}
+}
+
+func (r *Room) unsubscribe(sub *subscription) {
+	if sub.threadID != 0 {
+		if !r.unfollow(sub.client, sub.threadID) {
+			if sub.ref != "" {
+				r.hub.sendTo(sub.client, errorMessage(sub.ref, badRequest("not following thread %d", sub.threadID)))
+			}
+		} else if sub.ref != "" {
+			r.hub.sendTo(sub.client, &Message{RoomID: r.ID, ParentID: sub.threadID, Type: Ack, Ref: sub.ref})
+		}
+		return
+	}
+
+	if !r.removeSubscription(sub.client) {
+		if sub.ref != "" {
+			r.hub.sendTo(sub.client, errorMessage(sub.ref, badRequest("not subscribed to room %d", r.ID)))
+		}
+	} else if sub.ref != "" {
+		r.hub.sendTo(sub.client, &Message{RoomID: r.ID, Type: Ack, Ref: sub.ref})
+	}
+}
+
+// removeSubscription drops the client from the room and its threads and tells the
+// remaining clients that the user has left. It reports whether the client was subscribed.
+func (r *Room) removeSubscription(client *Client) bool {
+	r.unfollowAll(client)
+	if !r.isSubscribed(client) {
+		return false
+	}
+	delete(r.Clients, client.SessionID)
+	delete(r.replayed, client.SessionID)
+	r.members[client.ID]--
+	log.Println("Deleted client", client.ID, "session", client.SessionID, "from room", r.ID)
+	if r.empty() {
+		r.idle = time.Now()
+	}
+
+	if r.members[client.ID] > 0 {
+		return true
+	}
+	delete(r.members, client.ID)
+	r.stopTyping(client.ID)
+	if len(r.Clients) != 0 { // Only announce when the user's last device leaves
+		r.deliver(&Message{ // Broadcast a message saying that the user has left the room
+			Content:  client.Username + " left the room",
+			RoomID:   r.ID,
+			Username: client.Username,
+			SenderID: client.ID,
+			Type:     LeaveRoom,
+
+			announcement: true,
+		})
+	}
+	return true
+}
+
+// leave unsubscribes every session of the user from the room and its threads.
+func (r *Room) leave(userID int64) {
+	for _, client := range r.Clients {
+		if client.ID == userID {
+			r.removeSubscription(client)
+		}
+	}
+	for _, followers := range r.threads {
+		for _, client := range followers {
+			if client.ID == userID {
+				r.unfollowAll(client)
+			}
+		}
+	}
+}
+
+// route delivers a message sent through Broadcast or by a client op.
+func (r *Room) route(out *outbound) {
+	if out.sender == nil {
+		r.deliver(out.message)
+		return
+	}
+	if !r.isSubscribed(out.sender) {
+		r.hub.sendTo(out.sender, errorMessage(out.ref, badRequest("not subscribed to room %d", r.ID)))
+		return
+	}
+
+	if err := r.deliver(out.message); errors.Is(err, domain.ErrMessageIDNotFound) { // Replying to a message that cannot be replied to
+		r.hub.sendTo(out.sender, errorMessage(out.ref, badRequest(err.Error())))
+	} else if err != nil {
+		r.hub.sendTo(out.sender, errorMessage(out.ref, &ProtocolError{Code: CodeInternal, Message: "could not send message"}))
+	} else if out.ref != "" {
+		r.hub.sendTo(out.sender, &Message{
+			ID:        out.message.ID,
+			RoomID:    out.message.RoomID,
+			SenderID:  out.message.SenderID,
+			Type:      Ack,
+			Ref:       out.ref,
+			Seq:       out.message.Seq,
+			CreatedAt: out.message.CreatedAt,
+			ParentID:  out.message.ParentID,
+		})
+	}
+}
+
+// event sends a room message that is not stored and acks it to the sender.
+func (r *Room) event(out *outbound) {
+	r.emit(out.message)
+	if out.sender != nil && out.ref != "" {
+		ack := *out.message
+		ack.Type, ack.Ref = Ack, out.ref
+		r.hub.sendTo(out.sender, &ack)
+	}
+}
+
+func (r *Room) deliver(message *Message) error {
+	if err := r.hub.saveMessage(message); err != nil { // Never deliver a message that was not recorded
+		log.Printf("could not save message for room %d: %v", message.RoomID, err)
+		return err
+	}
+	r.emit(message)
+	if message.ParentID != 0 {
+		r.threadUpdated(message.ParentID)
+	}
+	if len(message.Mentions) != 0 {
+		r.hub.mention(message)
+	}
+	return nil
+}
+
+// threadUpdated sends the new reply count of a message that was replied to.
+func (r *Room) threadUpdated(parentID int64) {
+	parent, err := r.hub.messages.GetMessage(context.Background(), parentID)
+	if err != nil {
+		log.Printf("could not load message %d after a reply: %v", parentID, err)
+		return
+	}
+	r.emit(threadMessage(parent))
+}
+
+// emit sends a room message to the room's clients on this and every other instance.
+// Unlike deliver it does not store the message.
+func (r *Room) emit(message *Message) {
+	r.fanOut(message)
+	r.hub.publish(message)
+}
+
+// fanOut pushes a room message to the clients of this instance subscribed to the
+// room, and to those following the thread the message belongs to.
+func (r *Room) fanOut(message *Message) {
+	for _, cl := range r.Clients {
+		if (message.Type == TypingStart || message.Type == TypingStop) && cl.ID == message.SenderID {
+			continue // Typing is not echoed to the typing user's own devices
+		}
+		r.push(cl, message)
+	}
+
+	threadID := message.ParentID
+	if threadID == 0 {
+		threadID = message.ID // Events about the message that starts the thread
+	}
+	for _, cl := range r.threads[threadID] {
+		if !r.isSubscribed(cl) {
+			r.push(cl, message)
+		}
+	}
+}
+
+// push queues a room message for a subscribed client, skipping stored messages the
+// client was already sent by a replay. Live messages are not checked against each
+// other: messages from other instances may arrive slightly out of order.
+func (r *Room) push(client *Client, message *Message) {
+	if message.Seq != 0 && message.Seq <= r.replayed[client.SessionID] {
+		return
+	}
+	r.hub.enqueue(client, message)
+}
+
+// replay sends the client the stored messages of the room after since. Runs before
+// the client is added to the room, so nothing is missed in between.
+func (r *Room) replay(client *Client, since int64, ref string) {
+	messages, err := r.hub.messages.GetMessagesSince(context.Background(), r.ID, since, domain.MaxReplayMessages+1)
+	if err != nil {
+		log.Printf("could not replay room %d since %d: %v", r.ID, since, err)
+		r.hub.sendTo(client, errorMessage(ref, &ProtocolError{Code: CodeInternal, Message: "could not replay missed messages"}))
+		return
+	}
+	if len(messages) > domain.MaxReplayMessages {
+		r.hub.sendTo(client, errorMessage(ref, &ProtocolError{
+			Code:    CodeResumeGap,
+			Message: fmt.Sprintf("more than %d messages were missed in room %d, load the history instead", domain.MaxReplayMessages, r.ID),
+		}))
+		return
+	}
+	for _, m := range messages {
+		r.push(client, messageFromDomain(m))
+		r.replayed[client.SessionID] = m.Seq
+	}
+}
+
+func (r *Room) clientInfo() []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	index := make(map[int64]int)
+	for _, c := range r.Clients {
+		i, ok := index[c.ID]
+		if !ok {
+			i = len(clients)
+			index[c.ID] = i
+			clients = append(clients, ClientInfo{
+				ID:       c.ID,
+				Username: c.Username,
+			})
+		}
+		clients[i].Devices = append(clients[i].Devices, DeviceInfo{
+			SessionID:   c.SessionID,
+			Device:      c.Device,
+			ConnectedAt: c.ConnectedAt,
+		})
+	}
+	return clients
+}
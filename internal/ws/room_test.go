@@ -0,0 +1,84 @@
+package ws_test
+
+import (
+	"fmt"
+	"server/internal/ws"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomStopsWhenIdle(t *testing.T) {
+	config := ws.DefaultConfig()
+	config.RoomIdleTimeout = 50 * time.Millisecond
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+
+	client, _ := streamClient(hub, 1, 1)
+	hub.AddRoom(2, "nobody here")
+	require.Equal(t, 2, hub.ActiveRooms())
+
+	// The room with a client keeps running
+	require.Eventually(t, func() bool { return hub.ActiveRooms() == 1 }, time.Second, 10*time.Millisecond)
+	require.Len(t, hub.OnlineClients(1), 1)
+
+	hub.Unsubscribe(client, 1)
+	require.Eventually(t, func() bool { return hub.ActiveRooms() == 0 }, time.Second, 10*time.Millisecond)
+	require.Empty(t, hub.OnlineClients(1))
+
+	// A stopped room starts again when it is used
+	hub.Subscribe(client, 1)
+	require.Len(t, hub.OnlineClients(1), 1)
+	require.Equal(t, 1, hub.ActiveRooms())
+}
+
+// BenchmarkHubFanOut broadcasts from parallel senders to 200 rooms of 20 clients each
+// and waits until every message has reached the send queue of every client in its room.
+func BenchmarkHubFanOut(b *testing.B) {
+	const rooms = 200
+	const clientsPerRoom = 20
+
+	config := ws.DefaultConfig()
+	config.SendQueueSize = 1024
+	config.QueuePolicy = ws.DropOldest // Dropped messages are counted instead of stopping the benchmark
+	hub := ws.NewHub(&memoryMessageService{}, &memoryJoiner{}, &memoryPresenceStore{}, ws.NewMemoryBroker().Node(), config)
+	go hub.Run()
+
+	var delivered int64
+	for r := int64(1); r <= rooms; r++ {
+		for i := int64(0); i < clientsPerRoom; i++ {
+			client := hub.NewClient(nil, r*1000+i, fmt.Sprintf("user%d", r*1000+i), "bench")
+			go func() {
+				for m := range client.Message {
+					if m.Content == "bench" {
+						atomic.AddInt64(&delivered, 1)
+					}
+				}
+			}()
+			hub.Register(client)
+			hub.Subscribe(client, r)
+		}
+		hub.OnlineClients(r) // Wait for the joins
+	}
+
+	var next int64
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			roomID := atomic.AddInt64(&next, 1)%rooms + 1
+			hub.Broadcast(&ws.Message{Content: "bench", RoomID: roomID, SenderID: 1, Type: ws.Normal})
+		}
+	})
+	want := int64(b.N) * clientsPerRoom
+	for atomic.LoadInt64(&delivered)+hub.QueueStats().Dropped < want {
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(want)/elapsed.Seconds(), "deliveries/s")
+	b.ReportMetric(float64(hub.QueueStats().Dropped), "dropped")
+}
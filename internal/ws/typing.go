@@ -0,0 +1,98 @@
+package ws
+
+import "time"
+
+const (
+	// TypingTimeout is the default Config.TypingTimeout.
+	TypingTimeout = 5 * time.Second
+	// TypingRateLimit is the number of typing frames a client may send per second.
+	TypingRateLimit = 5
+)
+
+type typingRequest struct {
+	client *Client
+	roomID int64
+	start  bool
+	ref    string
+}
+
+// typist is a user currently shown as typing in a room.
+type typist struct {
+	username string
+	expires  time.Time
+}
+
+func (h *Hub) setTyping(req *typingRequest) {
+	ok := h.inRoom(req.roomID, false, func(r *Room) {
+		r.setTyping(req)
+	})
+	if !ok {
+		h.sendTo(req.client, errorMessage(req.ref, badRequest("not subscribed to room %d", req.roomID)))
+	}
+}
+
+// setTyping starts, renews or stops the client's user typing in the room. Only the
+// first start and the stop are sent to the room; renewals just push back the expiry.
+func (r *Room) setTyping(req *typingRequest) {
+	client := req.client
+	if !r.isSubscribed(client) {
+		r.hub.sendTo(client, errorMessage(req.ref, badRequest("not subscribed to room %d", r.ID)))
+		return
+	}
+	if !client.allowTyping(time.Now()) {
+		r.hub.sendTo(client, errorMessage(req.ref, &ProtocolError{Code: CodeRateLimited, Message: "too many typing events"}))
+		return
+	}
+
+	if req.start {
+		_, typing := r.typing[client.ID]
+		r.typing[client.ID] = &typist{username: client.Username, expires: time.Now().Add(r.hub.config.TypingTimeout)}
+		if !typing {
+			r.emit(typingMessage(TypingStart, r.ID, client.ID, client.Username))
+		}
+	} else {
+		r.stopTyping(client.ID)
+	}
+
+	if req.ref != "" {
+		r.hub.sendTo(client, &Message{RoomID: r.ID, Type: Ack, Ref: req.ref})
+	}
+}
+
+func (r *Room) stopTyping(userID int64) {
+	t, ok := r.typing[userID]
+	if !ok {
+		return
+	}
+	delete(r.typing, userID)
+	r.emit(typingMessage(TypingStop, r.ID, userID, t.username))
+}
+
+// expireTyping stops every user whose typing was not renewed in time.
+func (r *Room) expireTyping(now time.Time) {
+	for userID, t := range r.typing {
+		if now.After(t.expires) {
+			r.stopTyping(userID)
+		}
+	}
+}
+
+func typingMessage(typ MessageType, roomID int64, userID int64, username string) *Message {
+	return &Message{
+		RoomID:   roomID,
+		SenderID: userID,
+		Username: username,
+		Type:     typ,
+	}
+}
+
+// allowTyping reports whether another typing frame fits in the client's rate limit.
+func (c *Client) allowTyping(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.typingWindow) >= time.Second {
+		c.typingWindow, c.typingCount = now, 0
+	}
+	c.typingCount++
+	return c.typingCount <= TypingRateLimit
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"server/internal/domain"
 	"server/internal/handler"
 	"server/internal/middleware"
 	"time"
@@ -11,14 +12,14 @@ import (
 
 var r *gin.Engine
 
-func InitRouter(userHandler *handler.UserHandler, wsHandler *handler.WSHandler) {
+func InitRouter(userHandler *handler.UserHandler, wsHandler *handler.WSHandler, messageHandler *handler.MessageHandler, sessionHandler *handler.SessionHandler) {
 	r = gin.Default()
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000"},
 		AllowMethods:     []string{"GET", "POST", "PATCH", "DELETE", "PUT"},
 		AllowHeaders:     []string{"Content-Type", "Authorization", "Origin", "Accept", "X-Requested-With", "Access-Control-Request-Method", "Access-Control-Request-Headers", "Access-Control-Allow-Origin", "Access-Control-Allow-Headers", "Access-Control-Allow-Methods", "Access-Control-Allow-Credentials"},
-		ExposeHeaders:    []string{"Content-Length"},
+		ExposeHeaders:    []string{"Content-Length", "X-Next-Cursor"},
 		AllowCredentials: true,
 		AllowOriginFunc: func(origin string) bool {
 			return origin == "http://localhost:3000"
@@ -29,25 +30,47 @@ func InitRouter(userHandler *handler.UserHandler, wsHandler *handler.WSHandler)
 	r.GET("/", wsHandler.Home)
 	r.POST("/signup", userHandler.CreateUser)
 	r.POST("/login", userHandler.Login)
-	r.GET("/logout", userHandler.Logout)
-
-	r.DELETE("/user", userHandler.DeleteAllUsers)
-	r.DELETE("/chatRoom", wsHandler.DeleteAllRooms)
+	r.POST("/token/refresh", sessionHandler.Refresh)
 
+	r.GET("/ws/connect", wsHandler.Connect)
 	r.GET("/ws/joinRoom/:roomId", wsHandler.JoinRoom)
 
-	r.Use(middleware.AuthorizeJWT())
+	r.Use(middleware.AuthorizeJWT(sessionHandler.SessionServicePort))
 	{
+		r.POST("/logout", sessionHandler.Logout)
 		r.GET("/users", userHandler.GetAllUsers)
+		r.GET("/users/:userId/presence", wsHandler.GetPresence)
 		r.PATCH("/user/self", userHandler.UpdateUsername)
 		r.PATCH("/user/self/password", userHandler.UpdatePassword)
+		r.GET("/user/self/mentions", messageHandler.GetMentions)
+		r.GET("/user/self/sessions", sessionHandler.GetSessions)
+		r.DELETE("/user/self/sessions", sessionHandler.RevokeSessions)
+		r.DELETE("/user/self/sessions/:sessionId", sessionHandler.RevokeSession)
+		r.GET("/search/messages", messageHandler.SearchMessages)
 		r.PATCH("/chatRoom/:roomId", wsHandler.UpdateRoom)
+		r.GET("/chatRoom/:roomId/messages", messageHandler.GetMessages)
+		r.GET("/chatRoom/:roomId/messages/:messageId/thread", messageHandler.GetThread)
+		r.GET("/chatRoom/:roomId/pins", messageHandler.GetPins)
+		r.PUT("/chatRoom/:roomId/pins/:messageId", messageHandler.PinMessage)
+		r.DELETE("/chatRoom/:roomId/pins/:messageId", messageHandler.UnpinMessage)
+		r.POST("/chatRoom/:roomId/read", messageHandler.MarkRead)
+		r.PATCH("/messages/:messageId", messageHandler.EditMessage)
+		r.DELETE("/messages/:messageId", messageHandler.DeleteMessage)
+		r.GET("/messages/:messageId/edits", messageHandler.GetMessageEdits)
+		r.PUT("/messages/:messageId/reactions/:emoji", messageHandler.AddReaction)
+		r.DELETE("/messages/:messageId/reactions/:emoji", messageHandler.RemoveReaction)
 		r.POST("/ws/createRoom", wsHandler.CreateRoom)
 		r.POST("/ws/createDM", wsHandler.CreateDM)
 		r.GET("/ws/leaveRoom/:roomId", wsHandler.LeaveRoom)
 		r.GET("/ws/getRooms", wsHandler.GetRooms)
 		r.GET("/ws/getDMs", wsHandler.GetDMs)
 		r.GET("/ws/getClients/:roomId", wsHandler.GetOnlineClientsInRoom) // Only show client that are now online (join the room) in the new connection
+		r.GET("/ws/stats", middleware.RequirePermission(domain.PermViewStats), wsHandler.GetQueueStats)
+		r.POST("/ws/ticket", wsHandler.Ticket)
+
+		r.PUT("/users/:userId/role", middleware.RequirePermission(domain.PermManageRoles), userHandler.UpdateRole)
+		r.DELETE("/user", middleware.RequirePermission(domain.PermWipeData), userHandler.DeleteAllUsers)
+		r.DELETE("/chatRoom", middleware.RequirePermission(domain.PermWipeData), wsHandler.DeleteAllRooms)
 	}
 }
 
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// StringFromEnv sets *s to the value of the environment variable key, if it is set.
+func StringFromEnv(key string, s *string) {
+	if value := os.Getenv(key); value != "" {
+		*s = value
+	}
+}
+
+// DurationFromEnv sets *d to the duration in the environment variable key, e.g. "30s".
+// An invalid or non-positive duration is logged and leaves *d as it is.
+func DurationFromEnv(key string, d *time.Duration) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("invalid %s %q, using %s", key, value, *d)
+		return
+	}
+	*d = parsed
+}